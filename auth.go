@@ -0,0 +1,57 @@
+package main
+
+import "sync"
+
+// authState holds the identity and tokens of a session. Reports, refreshes
+// and the command loop run concurrently, so every access goes through mu.
+type authState struct {
+	mu           sync.RWMutex
+	userID       string
+	accessToken  string
+	refreshToken string
+}
+
+// tokens returns a copy of the current identity and tokens
+func (a *authState) tokens() LoginResponse {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return LoginResponse{UserID: a.userID, AccessToken: a.accessToken, RefreshToken: a.refreshToken}
+}
+
+// set replaces the identity and tokens
+func (a *authState) set(tokens LoginResponse) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.userID, a.accessToken, a.refreshToken = tokens.UserID, tokens.AccessToken, tokens.RefreshToken
+}
+
+// update stores a login or refresh response, keeping the previous values
+// for any field the server left empty, and returns the resulting state
+func (a *authState) update(resp LoginResponse) LoginResponse {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if resp.UserID != "" {
+		a.userID = resp.UserID
+	}
+	a.accessToken = resp.AccessToken
+	if resp.RefreshToken != "" {
+		a.refreshToken = resp.RefreshToken
+	}
+	return LoginResponse{UserID: a.userID, AccessToken: a.accessToken, RefreshToken: a.refreshToken}
+}
+
+// clearTokens drops the tokens, keeping the identity
+func (a *authState) clearTokens() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.accessToken, a.refreshToken = "", ""
+}
+
+// UserID returns the user the client is logged in as
+func (c *Client) UserID() string { return c.auth.tokens().UserID }
+
+// AccessToken returns the current access token
+func (c *Client) AccessToken() string { return c.auth.tokens().AccessToken }
+
+// RefreshToken returns the current refresh token
+func (c *Client) RefreshToken() string { return c.auth.tokens().RefreshToken }
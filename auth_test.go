@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestRefreshWhileReporting refreshes the tokens while reports are built
+// and sent, for the race detector to check that the shared state is
+// guarded: go test -race -run TestRefreshWhileReporting
+func TestRefreshWhileReporting(t *testing.T) {
+	fakePvesh(t, map[string]string{clusterResourcesPath: `{"data":[{"type":"qemu","vmid":100}]}`})
+
+	var refreshes atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/user/refresh":
+			n := refreshes.Add(1)
+			json.NewEncoder(w).Encode(LoginResponse{AccessToken: fmt.Sprintf("token-%d", n), RefreshToken: fmt.Sprintf("refresh-%d", n)})
+		case "/api/vm/list":
+			if auth := r.Header.Get("Authorization"); !strings.HasPrefix(auth, "Bearer token") {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		}
+	})
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if _, err := c.RefreshAccessToken(ctx); err != nil {
+					t.Errorf("RefreshAccessToken: %v", err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				resp, err := c.GetVMs(ctx)
+				if err != nil {
+					t.Errorf("GetVMs: %v", err)
+					return
+				}
+				if resp.UserId != "user" || resp.Vms[0].UserID != "user" {
+					t.Errorf("report attributed to %q, want user", resp.UserId)
+				}
+				if err := c.SendToServer(ctx, *resp); err != nil {
+					t.Errorf("SendToServer: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := refreshes.Load(); n != 40 {
+		t.Errorf("refreshes = %d, want 40", n)
+	}
+	if !strings.HasPrefix(c.AccessToken(), "token-") || !strings.HasPrefix(c.RefreshToken(), "refresh-") {
+		t.Errorf("tokens = %q, %q, want refreshed ones", c.AccessToken(), c.RefreshToken())
+	}
+}
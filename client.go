@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Client collects VM information and reports it to the Hyper-Desk server
+type Client struct {
+	// ServerURL is the base URL of the Hyper-Desk server
+	ServerURL string
+
+	// Credentials supplies the login credentials when the refresh token is
+	// rejected and a fresh login is required
+	Credentials func() (LoginCredentials, error)
+
+	// TokenCacheFile persists the tokens across restarts when set
+	TokenCacheFile string
+
+	// BasicAuthUser and BasicAuthPass, when set, authenticate every request
+	// to a reverse proxy in front of the server
+	BasicAuthUser string
+	BasicAuthPass string
+
+	// ContentType overrides the Content-Type of request bodies when set
+	ContentType string
+
+	// Headers are added to every request to the server, e.g. for routing
+	// through an API gateway
+	Headers http.Header
+
+	// StaticToken marks an access token provisioned out-of-band, which the
+	// client never refreshes or replaces with a login
+	StaticToken bool
+
+	// auth is the session's identity and tokens
+	auth authState
+
+	// reauthMu serializes refreshes and logins, so concurrent sends
+	// rejected with the same token do not race to spend one refresh token
+	reauthMu sync.Mutex
+
+	httpClient     *http.Client
+	proxmoxVersion ProxmoxVersion
+}
+
+// NewClient creates a client reporting to serverURL over httpClient
+func NewClient(serverURL string, httpClient *http.Client) *Client {
+	return &Client{
+		ServerURL:  serverURL,
+		httpClient: httpClient,
+	}
+}
+
+// maxPayloadBytes bounds the size of a report body, or is 0 for no limit
+var maxPayloadBytes = 10 << 20
+
+// errPayloadTooLarge is returned for reports larger than maxPayloadBytes
+var errPayloadTooLarge = errors.New("payload too large")
+
+// checkPayloadSize rejects bodies over maxPayloadBytes before they reach
+// the server's ingest endpoint
+func checkPayloadSize(data []byte, vms int) error {
+	if maxPayloadBytes <= 0 || len(data) <= maxPayloadBytes {
+		return nil
+	}
+	slog.Error("Report exceeds MAX_PAYLOAD_BYTES, skipping", "bytes", len(data), "max", maxPayloadBytes, "vms", vms)
+	return fmt.Errorf("%w: %d bytes exceeds %d", errPayloadTooLarge, len(data), maxPayloadBytes)
+}
+
+// errStaticToken is returned instead of refreshing or logging in when the
+// access token is provisioned out-of-band
+var errStaticToken = errors.New("access token is provisioned externally, not refreshing")
+
+// UseStaticToken authenticates as userID with an access token provisioned
+// out-of-band, skipping login and disabling refresh
+func (c *Client) UseStaticToken(userID, accessToken string) {
+	c.StaticToken = true
+	c.Credentials = nil
+	c.auth.set(LoginResponse{UserID: userID, AccessToken: accessToken})
+}
+
+// apiBasePath is the path of the server's API below SERVER_URL
+var apiBasePath = "/api"
+
+func (c *Client) loginEndpoint() string   { return c.ServerURL + apiBasePath + "/user/login" }
+func (c *Client) refreshEndpoint() string { return c.ServerURL + apiBasePath + "/user/refresh" }
+
+// vmListEndpoint returns the report endpoint of the backend at serverURL
+func vmListEndpoint(serverURL string) string { return serverURL + apiBasePath + "/vm/list" }
+
+// newRequest builds a request to the server with a JSON body and the headers
+// common to every request
+func (c *Client) newRequest(ctx context.Context, method, url string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	contentType := "application/json"
+	if c.ContentType != "" {
+		contentType = c.ContentType
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", userAgent())
+	for key, values := range c.Headers {
+		req.Header[key] = values
+	}
+	if c.BasicAuthUser != "" {
+		req.SetBasicAuth(c.BasicAuthUser, c.BasicAuthPass)
+	}
+	return req, nil
+}
+
+// setBearer authenticates req with the access token. Basic auth occupies
+// the Authorization header when configured, so the token then travels in
+// the X-Access-Token header instead.
+func (c *Client) setBearer(req *http.Request) {
+	if c.BasicAuthUser != "" {
+		req.Header.Set("X-Access-Token", c.AccessToken())
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+c.AccessToken())
+}
+
+// userAgent identifies this client build to the server
+func userAgent() string {
+	return "HyperDeskClient/" + version
+}
+
+// setTokens stores the identity and tokens from a login or refresh response,
+// keeping the previous values for any field the server left empty
+func (c *Client) setTokens(loginResp *LoginResponse) {
+	tokens := c.auth.update(*loginResp)
+
+	if c.TokenCacheFile != "" {
+		if err := saveTokenCache(c.TokenCacheFile, tokens); err != nil {
+			slog.Warn("Error saving token cache", "file", c.TokenCacheFile, "error", err)
+		}
+	}
+}
+
+// Reauthenticate refreshes the access token, falling back to a fresh login
+// with the client's credentials when the refresh token is rejected. Callers
+// that were rejected while another call was already reauthenticating reuse
+// its new token.
+func (c *Client) Reauthenticate(ctx context.Context) error {
+	if c.StaticToken {
+		return errStaticToken
+	}
+
+	rejected := c.AccessToken()
+	c.reauthMu.Lock()
+	defer c.reauthMu.Unlock()
+	if c.AccessToken() != rejected {
+		return nil
+	}
+	_, err := c.RefreshAccessToken(ctx)
+	if errors.Is(err, errUnauthorized) && c.Credentials != nil {
+		slog.Warn("Refresh token rejected, please log in again")
+		err = c.loginWithCredentials(ctx)
+	}
+	return err
+}
+
+// ResetSession discards the current and cached tokens and logs in again
+// with the client's credentials
+func (c *Client) ResetSession(ctx context.Context) error {
+	if c.StaticToken {
+		return errStaticToken
+	}
+
+	c.reauthMu.Lock()
+	defer c.reauthMu.Unlock()
+	c.auth.clearTokens()
+	if c.TokenCacheFile != "" {
+		if err := os.Remove(c.TokenCacheFile); err != nil && !os.IsNotExist(err) {
+			slog.Warn("Error removing token cache", "file", c.TokenCacheFile, "error", err)
+		}
+	}
+	if c.Credentials == nil {
+		return errors.New("no credentials available for a fresh login")
+	}
+
+	return c.loginWithCredentials(ctx)
+}
+
+// loginWithCredentials logs in with freshly resolved credentials. Failing
+// to resolve them, e.g. while a password file is being rotated, fails this
+// attempt only.
+func (c *Client) loginWithCredentials(ctx context.Context) error {
+	credentials, err := c.Credentials()
+	if err != nil {
+		return fmt.Errorf("failed to resolve credentials: %w", err)
+	}
+	_, err = c.Login(ctx, credentials)
+	return err
+}
+
+// Login sends a login request to the server and stores the returned tokens.
+// Connection errors and 5xx responses are retried with exponential backoff
+// up to loginRetries attempts, since the server may still be starting.
+func (c *Client) Login(ctx context.Context, credentials LoginCredentials) (*LoginResponse, error) {
+	// Convert credentials to JSON
+	body, err := json.Marshal(credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= loginRetries; attempt++ {
+		if attempt > 1 {
+			delay := retryBaseDelay * time.Duration(1<<(attempt-2))
+			slog.Warn("Login attempt failed, retrying", "attempt", attempt-1, "loginRetries", loginRetries, "error", lastErr, "delay", delay.String())
+			if err := sleepContext(ctx, delay); err != nil {
+				return nil, err
+			}
+		}
+
+		loginResp, retryable, err := c.postLogin(ctx, body)
+		if err == nil {
+			c.setTokens(loginResp)
+			return loginResp, nil
+		}
+		lastErr = err
+		if !retryable {
+			break
+		}
+	}
+
+	return nil, lastErr
+}
+
+// postLogin performs a single login POST and reports whether a failure is
+// worth retrying
+func (c *Client) postLogin(ctx context.Context, body []byte) (*LoginResponse, bool, error) {
+	req, err := c.newRequest(ctx, "POST", c.loginEndpoint(), body)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Send POST request to login endpoint
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, ctx.Err() == nil, fmt.Errorf("login request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Check response status code
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode >= 500, fmt.Errorf("login failed with status code: %d", resp.StatusCode)
+	}
+
+	// Parse response body
+	var loginResp LoginResponse
+	err = json.NewDecoder(resp.Body).Decode(&loginResp)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to decode login response: %v", err)
+	}
+
+	// Running without an identity would misattribute every report
+	if loginResp.UserID == "" {
+		return nil, false, fmt.Errorf("%w: missing userId", errInvalidLoginResponse)
+	}
+	if loginResp.AccessToken == "" {
+		return nil, false, fmt.Errorf("%w: missing accessToken", errInvalidLoginResponse)
+	}
+
+	return &loginResp, false, nil
+}
+
+// RefreshAccessToken exchanges the refresh token for a new set of tokens
+// and stores them
+func (c *Client) RefreshAccessToken(ctx context.Context) (*LoginResponse, error) {
+	// Convert refresh token to JSON
+	body, err := json.Marshal(RefreshRequest{RefreshToken: c.RefreshToken()})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := c.newRequest(ctx, "POST", c.refreshEndpoint(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Send POST request to refresh endpoint
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("refresh request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Check response status code
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf("refresh failed: %w", errUnauthorized)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("refresh failed with status code: %d", resp.StatusCode)
+	}
+
+	// Parse response body
+	var loginResp LoginResponse
+	err = json.NewDecoder(resp.Body).Decode(&loginResp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode refresh response: %v", err)
+	}
+	if loginResp.AccessToken == "" {
+		return nil, fmt.Errorf("%w: missing accessToken", errInvalidLoginResponse)
+	}
+
+	c.setTokens(&loginResp)
+	return &loginResp, nil
+}
+
+// SendToServer sends the VM list to the client's server
+func (c *Client) SendToServer(ctx context.Context, vmList Response) error {
+	return c.SendToURL(ctx, c.ServerURL, vmList)
+}
+
+// SendToURL sends the VM list to the backend at serverURL, split into
+// batches of at most maxVMsPerRequest guests when that limit is set
+func (c *Client) SendToURL(ctx context.Context, serverURL string, vmList Response) error {
+	if maxVMsPerRequest <= 0 || len(vmList.Vms) <= maxVMsPerRequest {
+		return c.sendBatch(ctx, serverURL, vmList)
+	}
+
+	batches := (len(vmList.Vms) + maxVMsPerRequest - 1) / maxVMsPerRequest
+	for i := 0; i < batches; i++ {
+		batch := vmList
+		batch.Vms = vmList.Vms[i*maxVMsPerRequest : min((i+1)*maxVMsPerRequest, len(vmList.Vms))]
+		if err := c.sendBatch(ctx, serverURL, batch); err != nil {
+			return fmt.Errorf("batch %d/%d: %w", i+1, batches, err)
+		}
+		slog.Info("Sent report batch", "url", serverURL, "batch", i+1, "batches", batches, "vms", len(batch.Vms))
+	}
+	return nil
+}
+
+// sendBatch sends a single report to the backend at serverURL,
+// authenticated with the current access token
+func (c *Client) sendBatch(ctx context.Context, serverURL string, vmList Response) error {
+	if c.AccessToken() == "" {
+		return errors.New("no access token available, refusing to send unauthenticated request")
+	}
+
+	data, err := marshalReport(vmList, schemaVersion)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	size, err := c.postBody(ctx, serverURL, data, len(vmList.Vms))
+	if err != nil {
+		return err
+	}
+	slog.Info("Report sent", "url", serverURL, "vms", len(vmList.Vms), "bytes", size, "duration", time.Since(start).String())
+	return nil
+}
+
+// postBody POSTs a JSON body holding vms guests to the report endpoint of
+// the backend at serverURL, compressed and signed like every report, and
+// returns the number of bytes sent. Network errors, 5xx and 429 responses
+// are retried with exponential backoff up to maxRetries attempts, waiting
+// as long as a 429 response's Retry-After asks instead. The final error is
+// prefixed with its classifyError category.
+func (c *Client) postBody(ctx context.Context, serverURL string, data []byte, vms int) (int, error) {
+	var err error
+	if compressReports {
+		data, err = gzipBytes(data)
+		if err != nil {
+			return 0, fmt.Errorf("failed to compress report: %v", err)
+		}
+	}
+	if err := checkPayloadSize(data, vms); err != nil {
+		return 0, err
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		if attempt > 1 {
+			delay := retryDelay(lastErr, retryBaseDelay*time.Duration(1<<(attempt-2)))
+			slog.Warn("Send attempt failed, retrying", "attempt", attempt-1, "maxRetries", maxRetries, "error", lastErr, "delay", delay.String())
+			if err := sleepContext(ctx, delay); err != nil {
+				return 0, err
+			}
+		}
+
+		retryable, err := c.postReport(ctx, vmListEndpoint(serverURL), data)
+		if err == nil {
+			return len(data), nil
+		}
+		lastErr = err
+		if !retryable {
+			break
+		}
+	}
+
+	return 0, fmt.Errorf("%s: %w", classifyError(lastErr, statusCode(lastErr)), lastErr)
+}
+
+// postReport performs a single POST of the report and reports whether a
+// failure is worth retrying
+func (c *Client) postReport(ctx context.Context, endpoint string, data []byte) (bool, error) {
+	req, err := c.newRequest(ctx, "POST", endpoint, data)
+	if err != nil {
+		return false, err
+	}
+	c.setBearer(req)
+	if compressReports {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	signBody(req, data)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		// Retrying is pointless once the caller has given up
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return true, &statusError{StatusCode: resp.StatusCode, Status: resp.Status, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode >= 500, &statusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	return false, nil
+}
+
+// signBody lets the server verify the body of req: X-Content-SHA256 holds
+// its SHA-256 and, when signingSecret is set, X-Signature its HMAC-SHA256.
+// Both cover the body as sent, i.e. after compression.
+func signBody(req *http.Request, body []byte) {
+	sum := sha256.Sum256(body)
+	req.Header.Set("X-Content-SHA256", hex.EncodeToString(sum[:]))
+
+	if signingSecret != "" {
+		mac := hmac.New(sha256.New, []byte(signingSecret))
+		mac.Write(body)
+		req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+}
+
+// gzipBytes compresses data with gzip
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sleepContext pauses for d, returning early with the context's error if
+// ctx is cancelled first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setVar sets *p to v for the duration of the test
+func setVar[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// newTestClient returns a client logged in as "user" with access token
+// "token", reporting to a test server serving handler
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	c := NewClient(srv.URL, srv.Client())
+	c.auth.set(LoginResponse{UserID: "user", AccessToken: "token", RefreshToken: "refresh"})
+	return c
+}
+
+func TestSendToServerSetsBearer(t *testing.T) {
+	var auth, path string
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		path = r.URL.Path
+	})
+
+	if err := c.SendToServer(context.Background(), Response{UserId: "user"}); err != nil {
+		t.Fatalf("SendToServer: %v", err)
+	}
+	if auth != "Bearer token" {
+		t.Errorf("Authorization = %q, want %q", auth, "Bearer token")
+	}
+	if path != "/api/vm/list" {
+		t.Errorf("path = %q, want /api/vm/list", path)
+	}
+}
+
+func TestSendToServerWithoutToken(t *testing.T) {
+	called := false
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+	c.auth.set(LoginResponse{UserID: "user"})
+
+	if err := c.SendToServer(context.Background(), Response{UserId: "user"}); err == nil {
+		t.Fatal("SendToServer without an access token succeeded")
+	}
+	if called {
+		t.Error("request sent without an access token")
+	}
+}
+
+func TestSendToServerRetriesServerErrors(t *testing.T) {
+	setVar(t, &retryBaseDelay, time.Millisecond)
+
+	var attempts atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+
+	if err := c.SendToServer(context.Background(), Response{UserId: "user"}); err != nil {
+		t.Fatalf("SendToServer: %v", err)
+	}
+	if n := attempts.Load(); n != 3 {
+		t.Errorf("attempts = %d, want 3", n)
+	}
+}
+
+func TestSendToServerCompresses(t *testing.T) {
+	setVar(t, &compressReports, true)
+
+	var encoding string
+	var got Response
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("body is not gzip: %v", err)
+			return
+		}
+		body, err := io.ReadAll(zr)
+		if err != nil {
+			t.Errorf("reading gzip body: %v", err)
+			return
+		}
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Errorf("decompressed body is not JSON: %v", err)
+		}
+	})
+
+	report := Response{UserId: "user", Vms: []VMInfo{{VMID: 100, Name: "web"}}}
+	if err := c.SendToServer(context.Background(), report); err != nil {
+		t.Fatalf("SendToServer: %v", err)
+	}
+	if encoding != "gzip" {
+		t.Errorf("Content-Encoding = %q, want gzip", encoding)
+	}
+	if len(got.Vms) != 1 || got.Vms[0].VMID != 100 {
+		t.Errorf("decompressed report = %+v, want VM 100", got)
+	}
+}
+
+func TestSendToServerSignsBody(t *testing.T) {
+	setVar(t, &compressReports, true)
+	setVar(t, &signingSecret, "secret")
+
+	var sumHeader, sigHeader string
+	var body []byte
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		sumHeader = r.Header.Get("X-Content-SHA256")
+		sigHeader = r.Header.Get("X-Signature")
+		body, _ = io.ReadAll(r.Body)
+	})
+
+	if err := c.SendToServer(context.Background(), testReport); err != nil {
+		t.Fatalf("SendToServer: %v", err)
+	}
+
+	sum := sha256.Sum256(body)
+	if want := hex.EncodeToString(sum[:]); sumHeader != want {
+		t.Errorf("X-Content-SHA256 = %q, want the body hash %q", sumHeader, want)
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); sigHeader != want {
+		t.Errorf("X-Signature = %q, want %q", sigHeader, want)
+	}
+}
+
+func TestReauthenticateCredentialsError(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	c.Credentials = func() (LoginCredentials, error) {
+		return LoginCredentials{}, errors.New("password file missing")
+	}
+
+	if err := c.Reauthenticate(context.Background()); err == nil {
+		t.Fatal("Reauthenticate succeeded without credentials")
+	}
+	if c.AccessToken() != "token" {
+		t.Errorf("access token = %q, want the previous one kept", c.AccessToken())
+	}
+}
+
+func TestSendToServerErrorCategory(t *testing.T) {
+	setVar(t, &maxRetries, 1)
+
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+
+	err := c.SendToServer(context.Background(), Response{UserId: "user"})
+	if err == nil || !strings.HasPrefix(err.Error(), errorCategoryClient+": ") {
+		t.Fatalf("SendToServer error = %v, want it prefixed with %q", err, errorCategoryClient)
+	}
+	if code := statusCode(err); code != http.StatusBadRequest {
+		t.Errorf("statusCode = %d, want 400 through the category prefix", code)
+	}
+}
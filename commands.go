@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// allowedActions lists the guest lifecycle actions the backend may request
+var allowedActions = []string{"start", "stop", "reboot"}
+
+// Backoff between failed polls, doubling from commandBackoffBase up to
+// commandBackoffMax
+var (
+	commandBackoffBase = time.Second
+	commandBackoffMax  = 60 * time.Second
+)
+
+// commandPollInterval is the least time between the starts of two polls, so
+// a backend answering immediately instead of holding the request open is
+// not polled in a busy loop
+var commandPollInterval = time.Second
+
+// Command is a guest lifecycle action requested by the backend
+type Command struct {
+	ID     string      `json:"id"`
+	VMID   json.Number `json:"vmid"`
+	Action string      `json:"action"`
+}
+
+// CommandResult reports the outcome of a Command back to the backend
+type CommandResult struct {
+	ID      string `json:"id"`
+	VMID    int    `json:"vmid"`
+	Action  string `json:"action"`
+	Success bool   `json:"success"`
+	Output  string `json:"output,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (c *Client) commandsEndpoint() string {
+	return c.ServerURL + apiBasePath + "/vm/commands?userId=" + url.QueryEscape(c.UserID())
+}
+
+func (c *Client) commandResultEndpoint() string {
+	return c.ServerURL + apiBasePath + "/vm/commands/result"
+}
+
+// RunCommandLoop long-polls the backend for commands and executes them until
+// ctx is cancelled. Guests are looked up in the latest snapshot so only
+// known guests on known nodes can be targeted.
+func (c *Client) RunCommandLoop(ctx context.Context) {
+	jitter := newJitter()
+	failures := 0
+
+	for ctx.Err() == nil {
+		pollStart := time.Now()
+		commands, err := c.pollCommands(ctx)
+		if errors.Is(err, errUnauthorized) {
+			err = c.Reauthenticate(ctx)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			failures++
+			delay := commandBackoff(failures)
+			// Spread reconnects over the upper half of the delay
+			delay = delay/2 + jitter.next(delay/2)
+			if failures == 1 {
+				slog.Warn("Command channel disconnected, reconnecting", "error", err, "delay", delay.String())
+			} else {
+				slog.Debug("Command channel still disconnected", "failures", failures, "error", err, "delay", delay.String())
+			}
+			sleepContext(ctx, delay)
+			continue
+		}
+		if failures > 0 {
+			slog.Info("Command channel reconnected", "failures", failures)
+			failures = 0
+		}
+
+		for _, cmd := range commands {
+			result := c.executeCommand(ctx, cmd)
+			if err := c.postCommandResult(ctx, result); err != nil {
+				slog.Error("Error reporting command result", "id", cmd.ID, "error", err)
+			}
+		}
+		sleepContext(ctx, commandPollInterval-time.Since(pollStart))
+	}
+}
+
+// commandBackoff returns the delay after the given number of consecutive
+// failed polls
+func commandBackoff(failures int) time.Duration {
+	delay := commandBackoffBase
+	for i := 1; i < failures && delay < commandBackoffMax; i++ {
+		delay *= 2
+	}
+	return min(delay, commandBackoffMax)
+}
+
+// pollCommands fetches the pending commands for this user
+func (c *Client) pollCommands(ctx context.Context) ([]Command, error) {
+	req, err := c.newRequest(ctx, "GET", c.commandsEndpoint(), nil)
+	if err != nil {
+		return nil, err
+	}
+	c.setBearer(req)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("command poll failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	var commands []Command
+	if err := json.NewDecoder(resp.Body).Decode(&commands); err != nil {
+		return nil, fmt.Errorf("failed to decode commands: %v", err)
+	}
+	return commands, nil
+}
+
+// executeCommand validates and runs a single command
+func (c *Client) executeCommand(ctx context.Context, cmd Command) CommandResult {
+	result := CommandResult{ID: cmd.ID, Action: cmd.Action}
+
+	fail := func(err error) CommandResult {
+		slog.Warn("Command failed", "id", cmd.ID, "vmid", cmd.VMID.String(), "action", cmd.Action, "error", err)
+		result.Error = err.Error()
+		return result
+	}
+
+	// Only whitelisted actions on numeric VMIDs ever reach pvesh
+	if !slices.Contains(allowedActions, cmd.Action) {
+		return fail(fmt.Errorf("action %q is not allowed", cmd.Action))
+	}
+	vmid, err := strconv.Atoi(cmd.VMID.String())
+	if err != nil || vmid <= 0 {
+		return fail(fmt.Errorf("invalid vmid %q", cmd.VMID.String()))
+	}
+	result.VMID = vmid
+
+	vm, ok := latestVM(vmid)
+	if !ok {
+		return fail(fmt.Errorf("vmid %d not found in the latest snapshot", vmid))
+	}
+
+	path := fmt.Sprintf("/nodes/%s/%s/%d/status/%s", url.PathEscape(vm.Node), vm.Type, vmid, cmd.Action)
+	slog.Info("Executing command", "id", cmd.ID, "vmid", vmid, "action", cmd.Action, "node", vm.Node)
+	output, err := c.proxmoxCreate(ctx, path)
+	if err != nil {
+		return fail(err)
+	}
+
+	result.Success = true
+	result.Output = string(output)
+	return result
+}
+
+// postCommandResult reports a command result to the backend
+func (c *Client) postCommandResult(ctx context.Context, result CommandResult) error {
+	// Results must not be lost, so wait for the limiter instead of dropping
+	if err := outOfBandLimiter.Wait(ctx); err != nil {
+		return err
+	}
+	return c.postJSON(ctx, c.commandResultEndpoint(), result)
+}
+
+// postJSON posts v as an uncompressed JSON body with the access token,
+// without retries
+func (c *Client) postJSON(ctx context.Context, endpoint string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	req, err := c.newRequest(ctx, "POST", endpoint, body)
+	if err != nil {
+		return err
+	}
+	c.setBearer(req)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return nil
+}
+
+// latestVM finds a guest in the most recently collected snapshot
+func latestVM(vmid int) (VMInfo, bool) {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+
+	if health.latest == nil {
+		return VMInfo{}, false
+	}
+	for _, vm := range health.latest.Vms {
+		if vm.VMID == vmid && (vm.Type == "qemu" || vm.Type == "lxc") {
+			return vm, true
+		}
+	}
+	return VMInfo{}, false
+}
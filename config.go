@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the optional configuration file given with --config. It is
+// YAML, and since YAML is a superset of JSON a JSON file works as well.
+// Every value maps to an environment variable; a variable that is already
+// set takes precedence over the file.
+type Config struct {
+	ServerURL      string   `yaml:"serverUrl"`
+	ServerURLs     []string `yaml:"serverUrls"`
+	ReportInterval string   `yaml:"reportInterval"`
+	LogLevel       string   `yaml:"logLevel"`
+
+	Credentials struct {
+		UserID   string `yaml:"userId"`
+		Password string `yaml:"password"`
+	} `yaml:"credentials"`
+
+	Filters struct {
+		Types            []string `yaml:"types"`
+		Status           string   `yaml:"status"`
+		ExcludeTemplates *bool    `yaml:"excludeTemplates"`
+		Node             string   `yaml:"node"`
+	} `yaml:"filters"`
+
+	TLS struct {
+		CertFile string `yaml:"certFile"`
+		KeyFile  string `yaml:"keyFile"`
+		CAFile   string `yaml:"caFile"`
+		CABundle string `yaml:"caBundleFile"`
+	} `yaml:"tls"`
+}
+
+// env returns the environment variables corresponding to the values set in
+// the file
+func (c *Config) env() map[string]string {
+	env := map[string]string{
+		"SERVER_URL":       c.ServerURL,
+		"SERVER_URLS":      strings.Join(c.ServerURLs, ","),
+		"REPORT_INTERVAL":  c.ReportInterval,
+		"LOG_LEVEL":        c.LogLevel,
+		"USER_ID":          c.Credentials.UserID,
+		"USER_PASSWORD":    c.Credentials.Password,
+		"REPORT_TYPES":     strings.Join(c.Filters.Types, ","),
+		"REPORT_STATUS":    c.Filters.Status,
+		"NODE_FILTER":      c.Filters.Node,
+		"CLIENT_CERT_FILE": c.TLS.CertFile,
+		"CLIENT_KEY_FILE":  c.TLS.KeyFile,
+		"CA_CERT_FILE":     c.TLS.CAFile,
+		"CA_BUNDLE_FILE":   c.TLS.CABundle,
+	}
+	if c.Filters.ExcludeTemplates != nil {
+		env["EXCLUDE_TEMPLATES"] = strconv.FormatBool(*c.Filters.ExcludeTemplates)
+	}
+	return env
+}
+
+// loadConfigFile reads the configuration file at path and exports its
+// values as environment variables that are not already set
+func loadConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	for key, value := range cfg.env() {
+		if value == "" {
+			continue
+		}
+		if _, ok := os.LookupEnv(key); ok {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
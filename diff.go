@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+)
+
+// logDiff logs the guests that changed between collections instead of
+// leaving operators to compare full reports
+var logDiff bool
+
+// diffThresholdPercent is the change in CPU or memory usage, in percentage
+// points, below which a guest's resources count as unchanged
+var diffThresholdPercent = 5.0
+
+// logVMDiff logs the guests added, removed or changed between the previous
+// and current snapshots. Nothing is logged for the first collection.
+func logVMDiff(prev, cur *Response) {
+	if prev == nil || cur == nil {
+		return
+	}
+
+	previous := make(map[int]VMInfo, len(prev.Vms))
+	for _, vm := range prev.Vms {
+		previous[vm.VMID] = vm
+	}
+
+	for _, vm := range cur.Vms {
+		old, ok := previous[vm.VMID]
+		delete(previous, vm.VMID)
+		if !ok {
+			slog.Info("Guest added", "vmid", vm.VMID, "name", vm.Name, "node", vm.Node, "status", vm.Status)
+			continue
+		}
+
+		var changes []any
+		if old.Status != vm.Status {
+			changes = append(changes, "status", old.Status+" -> "+vm.Status)
+		}
+		if old.Node != vm.Node {
+			changes = append(changes, "node", old.Node+" -> "+vm.Node)
+		}
+		if math.Abs(vm.CPUPercent-old.CPUPercent) >= diffThresholdPercent {
+			changes = append(changes, "cpuPercent", vm.CPUPercent, "previousCpuPercent", old.CPUPercent)
+		}
+		if math.Abs(vm.MemPercent-old.MemPercent) >= diffThresholdPercent {
+			changes = append(changes, "memPercent", vm.MemPercent, "previousMemPercent", old.MemPercent)
+		}
+		if old.MaxCPU != vm.MaxCPU || old.MaxMem != vm.MaxMem || old.MaxDisk != vm.MaxDisk {
+			changes = append(changes, "maxcpu", vm.MaxCPU, "maxmem", vm.MaxMem, "maxdisk", vm.MaxDisk)
+		}
+		if len(changes) > 0 {
+			slog.Info("Guest changed", append([]any{"vmid", vm.VMID, "name", vm.Name}, changes...)...)
+		}
+	}
+
+	for _, vm := range previous {
+		slog.Info("Guest removed", "vmid", vm.VMID, "name", vm.Name, "node", vm.Node)
+	}
+}
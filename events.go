@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// defaultEventRatePerMinute bounds out-of-band POSTs when
+// EVENT_RATE_PER_MINUTE is unset
+const defaultEventRatePerMinute = 30
+
+// maxPendingEvents caps the events held back while throttled
+const maxPendingEvents = 1000
+
+// outOfBandLimiter throttles event and command result POSTs so a flapping
+// guest cannot flood the backend. Scheduled reports bypass it.
+var outOfBandLimiter = newEventLimiter(defaultEventRatePerMinute)
+
+// newEventLimiter allows perMinute POSTs a minute with bursts of the same size
+func newEventLimiter(perMinute int) *rate.Limiter {
+	return rate.NewLimiter(rate.Every(time.Minute/time.Duration(perMinute)), perMinute)
+}
+
+// eventQueue holds status events throttled by outOfBandLimiter until the
+// next POST is allowed
+type eventQueue struct {
+	mu      sync.Mutex
+	pending []StatusEvent
+}
+
+var pendingEvents = &eventQueue{}
+
+// add coalesces events into the queue. A guest keeps a single event
+// spanning its first old and latest new status; guests that flapped back to
+// their original status are dropped, as are the oldest events beyond
+// maxPendingEvents. It returns the number of pending events.
+func (q *eventQueue) add(events []StatusEvent) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, event := range events {
+		i := slices.IndexFunc(q.pending, func(e StatusEvent) bool { return e.VMID == event.VMID })
+		if i < 0 {
+			q.pending = append(q.pending, event)
+			continue
+		}
+		event.OldStatus = q.pending[i].OldStatus
+		q.pending = slices.Delete(q.pending, i, i+1)
+		if event.OldStatus != event.NewStatus {
+			q.pending = append(q.pending, event)
+		}
+	}
+
+	if dropped := len(q.pending) - maxPendingEvents; dropped > 0 {
+		slog.Warn("Dropping throttled status events", "dropped", dropped)
+		q.pending = slices.Delete(q.pending, 0, dropped)
+	}
+	return len(q.pending)
+}
+
+// take empties the queue and returns its events
+func (q *eventQueue) take() []StatusEvent {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	events := q.pending
+	q.pending = nil
+	return events
+}
+
+// StatusEvent records a guest whose status changed between two collections
+type StatusEvent struct {
+	VMID        int       `json:"vmid"`
+	Name        string    `json:"name"`
+	Node        string    `json:"node"`
+	OldStatus   string    `json:"oldStatus"`
+	NewStatus   string    `json:"newStatus"`
+	CollectedAt time.Time `json:"collectedAt"`
+}
+
+// EventReport is the body of an out-of-band event POST
+type EventReport struct {
+	UserId      string        `json:"userId"`
+	CollectorID string        `json:"collectorId,omitempty"`
+	Events      []StatusEvent `json:"events"`
+}
+
+func (c *Client) eventsEndpoint() string { return c.ServerURL + apiBasePath + "/vm/events" }
+
+// statusChanges compares two snapshots and returns an event for every guest
+// present in both whose status differs. Guests that appeared or vanished
+// are left to the regular report.
+func statusChanges(prev, cur *Response) []StatusEvent {
+	if prev == nil || cur == nil {
+		return nil
+	}
+
+	previous := make(map[int]string, len(prev.Vms))
+	for _, vm := range prev.Vms {
+		previous[vm.VMID] = vm.Status
+	}
+
+	var events []StatusEvent
+	for _, vm := range cur.Vms {
+		old, ok := previous[vm.VMID]
+		if !ok || old == vm.Status {
+			continue
+		}
+		events = append(events, StatusEvent{
+			VMID:        vm.VMID,
+			Name:        vm.Name,
+			Node:        vm.Node,
+			OldStatus:   old,
+			NewStatus:   vm.Status,
+			CollectedAt: cur.CollectedAt,
+		})
+	}
+	return events
+}
+
+// SendEvents queues status events and posts everything pending unless
+// outOfBandLimiter is throttling, in which case the events wait for a later
+// call, so it should be called on every collection. It returns the number
+// of events posted. Events are best effort and are neither retried nor
+// spooled.
+func (c *Client) SendEvents(ctx context.Context, report EventReport) (int, error) {
+	pending := pendingEvents.add(report.Events)
+	if pending == 0 {
+		return 0, nil
+	}
+	if !outOfBandLimiter.Allow() {
+		slog.Warn("Throttling status events", "pending", pending)
+		return 0, nil
+	}
+
+	report.Events = pendingEvents.take()
+	return len(report.Events), c.postJSON(ctx, c.eventsEndpoint(), report)
+}
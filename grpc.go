@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"client/reportpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// transportGRPC streams reports to the ReportService of the backend
+const transportGRPC = "grpc"
+
+// grpcTransport streams reports over one long-lived ReportService stream
+// per backend, reopening it when it breaks. Unlike the other transports it
+// sends every field, regardless of REPORT_FIELDS and SCHEMA_VERSION.
+//
+// The backend answers a client stream only when it ends, so a stream it
+// rejects is noticed on the next send, which then reopens it.
+type grpcTransport struct {
+	client *Client
+	ctx    context.Context // Lifetime of the streams
+
+	mu      sync.Mutex
+	conns   map[string]*grpc.ClientConn
+	streams map[string]reportpb.ReportService_StreamReportsClient
+}
+
+// newGRPCTransport creates a gRPC transport sharing the dialer and TLS
+// settings of the client's HTTP transport. Its streams live until ctx is
+// cancelled or Close is called.
+func newGRPCTransport(ctx context.Context, client *Client) *grpcTransport {
+	return &grpcTransport{
+		client:  client,
+		ctx:     ctx,
+		conns:   make(map[string]*grpc.ClientConn),
+		streams: make(map[string]reportpb.ReportService_StreamReportsClient),
+	}
+}
+
+// SendToURL sends the report on the stream of the backend at serverURL. A
+// failed send drops the stream and is retried on a new one with exponential
+// backoff up to maxRetries attempts.
+func (t *grpcTransport) SendToURL(ctx context.Context, serverURL string, vmList Response) error {
+	if t.client.AccessToken() == "" {
+		return errors.New("no access token available, refusing to send unauthenticated request")
+	}
+
+	msg := responseToProto(vmList)
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err := checkPayloadSize(data, len(vmList.Vms)); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	var lastErr error
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		if attempt > 1 {
+			delay := retryBaseDelay * time.Duration(1<<(attempt-2))
+			slog.Warn("gRPC send failed, reopening stream", "attempt", attempt-1, "maxRetries", maxRetries, "error", lastErr, "delay", delay.String())
+			if err := sleepContext(ctx, delay); err != nil {
+				return err
+			}
+		}
+
+		err := t.send(serverURL, msg)
+		if err == nil {
+			slog.Info("Report sent over gRPC", "url", serverURL, "vms", len(vmList.Vms), "bytes", len(data), "duration", time.Since(start).String())
+			return nil
+		}
+		lastErr = err
+
+		// A rejected stream will not be accepted on retry
+		if statusCode(err) != 0 && statusCode(err) < 500 {
+			break
+		}
+	}
+
+	return lastErr
+}
+
+// send writes one message, opening the stream first if needed
+func (t *grpcTransport) send(serverURL string, msg *reportpb.Response) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stream := t.streams[serverURL]
+	if stream == nil {
+		var err error
+		stream, err = t.open(serverURL)
+		if err != nil {
+			return grpcError(err)
+		}
+		t.streams[serverURL] = stream
+	}
+
+	err := stream.Send(msg)
+	if err == nil {
+		return nil
+	}
+	delete(t.streams, serverURL)
+	// Send reports a broken stream as io.EOF, the cause is in its status
+	if errors.Is(err, io.EOF) {
+		_, err = stream.CloseAndRecv()
+	}
+	return fmt.Errorf("gRPC send failed: %w", grpcError(err))
+}
+
+// open opens an authenticated stream to serverURL, connecting to the
+// backend first if needed. The caller holds t.mu.
+func (t *grpcTransport) open(serverURL string) (reportpb.ReportService_StreamReportsClient, error) {
+	conn := t.conns[serverURL]
+	if conn == nil {
+		var err error
+		conn, err = t.connect(serverURL)
+		if err != nil {
+			return nil, err
+		}
+		t.conns[serverURL] = conn
+	}
+
+	stream, err := reportpb.NewReportServiceClient(conn).StreamReports(t.ctx)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Opened gRPC report stream", "url", serverURL)
+	return stream, nil
+}
+
+// connect creates a connection to the backend at serverURL, using TLS for
+// https URLs
+func (t *grpcTransport) connect(serverURL string) (*grpc.ClientConn, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	target := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		target = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	tlsConfig := &tls.Config{}
+	opts := []grpc.DialOption{
+		grpc.WithUserAgent(userAgent()),
+		grpc.WithPerRPCCredentials(grpcAuth{t.client}),
+	}
+	if transport, ok := t.client.httpClient.Transport.(*http.Transport); ok {
+		if transport.TLSClientConfig != nil {
+			tlsConfig = transport.TLSClientConfig.Clone()
+		}
+		opts = append(opts, grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return transport.DialContext(ctx, "tcp", addr)
+		}))
+	}
+	if u.Scheme == "https" {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	} else {
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+
+	return grpc.NewClient("passthrough:///"+target, opts...)
+}
+
+// Close closes every open stream and connection
+func (t *grpcTransport) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for serverURL, stream := range t.streams {
+		if summary, err := stream.CloseAndRecv(); err == nil {
+			slog.Debug("Closed gRPC report stream", "url", serverURL, "received", summary.GetReceived())
+		}
+		delete(t.streams, serverURL)
+	}
+	for serverURL, conn := range t.conns {
+		conn.Close()
+		delete(t.conns, serverURL)
+	}
+}
+
+// grpcAuth attaches the headers of the HTTP transport, including the access
+// token, to every stream
+type grpcAuth struct {
+	client *Client
+}
+
+func (a grpcAuth) GetRequestMetadata(ctx context.Context, _ ...string) (map[string]string, error) {
+	req, err := a.client.newRequest(ctx, "POST", a.client.ServerURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	a.client.setBearer(req)
+	req.Header.Del("Content-Type")
+	req.Header.Del("User-Agent")
+
+	md := make(map[string]string, len(req.Header))
+	for key, values := range req.Header {
+		md[strings.ToLower(key)] = strings.Join(values, ", ")
+	}
+	return md, nil
+}
+
+func (grpcAuth) RequireTransportSecurity() bool { return false }
+
+// grpcError maps the gRPC status of err onto the HTTP status errors the
+// send path understands, so rejected tokens trigger reauthentication
+func grpcError(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	switch st.Code() {
+	case codes.Unauthenticated:
+		return &statusError{StatusCode: http.StatusUnauthorized, Status: "401 Unauthorized: " + st.Message()}
+	case codes.PermissionDenied:
+		return &statusError{StatusCode: http.StatusForbidden, Status: "403 Forbidden: " + st.Message()}
+	case codes.InvalidArgument:
+		return &statusError{StatusCode: http.StatusBadRequest, Status: "400 Bad Request: " + st.Message()}
+	}
+	return err
+}
+
+// responseToProto converts a report to its protobuf message
+func responseToProto(r Response) *reportpb.Response {
+	msg := &reportpb.Response{
+		UserId:          r.UserId,
+		CollectorId:     r.CollectorID,
+		ProxmoxVersion:  &reportpb.ProxmoxVersion{Version: r.ProxmoxVersion.Version, Release: r.ProxmoxVersion.Release},
+		CollectedAt:     timestamppb.New(r.CollectedAt),
+		ClusterDegraded: r.ClusterDegraded,
+		Stale:           r.Stale,
+	}
+	for _, vm := range r.Vms {
+		msg.Vms = append(msg.Vms, &reportpb.VMInfo{
+			UserId:       vm.UserID,
+			Name:         vm.Name,
+			Node:         vm.Node,
+			Pool:         vm.Pool,
+			Tags:         vm.Tags,
+			Vmid:         int64(vm.VMID),
+			Type:         vm.Type,
+			Status:       vm.Status,
+			Cpu:          vm.CPU,
+			Maxcpu:       int64(vm.MaxCPU),
+			Mem:          vm.Mem,
+			Maxmem:       vm.MaxMem,
+			Disk:         vm.Disk,
+			Maxdisk:      vm.MaxDisk,
+			CpuPercent:   vm.CPUPercent,
+			MemPercent:   vm.MemPercent,
+			Uptime:       vm.Uptime,
+			Netin:        vm.NetIn,
+			Netout:       vm.NetOut,
+			Diskread:     vm.DiskRead,
+			Diskwrite:    vm.DiskWrite,
+			MemHuman:     vm.MemHuman,
+			DiskHuman:    vm.DiskHuman,
+			QmpStatus:    vm.QMPStatus,
+			Lock:         vm.Lock,
+			HaState:      vm.HAState,
+			Pid:          int64(vm.PID),
+			GuestAgentOk: vm.GuestAgentOK,
+
+			Overcommitted: vm.Overcommitted,
+		})
+	}
+	for _, node := range r.Nodes {
+		msg.Nodes = append(msg.Nodes, &reportpb.NodeInfo{
+			Node:   node.Node,
+			Status: node.Status,
+			Cpu:    node.CPU,
+			Maxcpu: int64(node.MaxCPU),
+			Mem:    node.Mem,
+			Maxmem: node.MaxMem,
+			Uptime: node.Uptime,
+		})
+	}
+	for _, task := range r.Tasks {
+		msg.Tasks = append(msg.Tasks, &reportpb.TaskInfo{
+			Type:      task.Type,
+			Status:    task.Status,
+			Node:      task.Node,
+			Id:        task.ID,
+			User:      task.User,
+			StartTime: timestamppb.New(task.StartTime),
+		})
+	}
+	for _, s := range r.Storage {
+		msg.Storage = append(msg.Storage, &reportpb.StorageInfo{
+			Storage: s.Storage,
+			Node:    s.Node,
+			Type:    s.Type,
+			Used:    s.Used,
+			Total:   s.Total,
+		})
+	}
+	if s := r.CollectorStats; s != nil {
+		msg.CollectorStats = &reportpb.CollectorStats{
+			CpuSeconds: s.CPUSeconds,
+			RssBytes:   s.RSSBytes,
+			Goroutines: int64(s.Goroutines),
+			Uptime:     s.Uptime,
+		}
+	}
+	return msg
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultHealthPort is the port of the health server when HEALTH_PORT is unset
+const defaultHealthPort = 8080
+
+// healthState tracks the collector's progress for the health server
+type healthState struct {
+	mu           sync.Mutex
+	loggedIn     bool
+	serverless   bool // No server is used, so no login is needed
+	lastSend     time.Time
+	reportsSent  uint64
+	sendFailures uint64
+	lastVMCount  int
+	latest       *Response
+
+	// breaker guards sends to the primary server
+	breaker *circuitBreaker
+}
+
+var health = &healthState{}
+
+// recordLogin marks the collector as logged in. The login time counts as
+// the last send so a freshly started collector is healthy.
+func (h *healthState) recordLogin() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.loggedIn = true
+	h.lastSend = time.Now()
+}
+
+// recordServerless marks a collector that writes reports locally and never
+// logs in as ready. The start counts as the last send like a login.
+func (h *healthState) recordServerless() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.serverless = true
+	h.lastSend = time.Now()
+}
+
+// recordSend records a successfully delivered report
+func (h *healthState) recordSend(vmCount int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastSend = time.Now()
+	h.reportsSent++
+	h.lastVMCount = vmCount
+}
+
+// recordSnapshot caches the most recently collected report
+func (h *healthState) recordSnapshot(response Response) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.latest = &response
+}
+
+// snapshot returns the most recently collected report, or nil
+func (h *healthState) snapshot() *Response {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.latest
+}
+
+// recordFailure records a report that could not be delivered
+func (h *healthState) recordFailure() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sendFailures++
+}
+
+// newHealthServer builds the server exposing /healthz, /metrics and /vms.
+// The collector is healthy while the last send is no older than two
+// intervals. /vms requires apiToken as a Bearer token when it is set.
+func newHealthServer(port int, interval time.Duration, apiToken string) *http.Server {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		health.mu.Lock()
+		healthy := (health.loggedIn || health.serverless) && time.Since(health.lastSend) <= 2*interval
+		breaker := health.breaker
+		health.mu.Unlock()
+
+		circuit := breakerClosed
+		if breaker != nil {
+			circuit = breaker.State()
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "unhealthy")
+		} else {
+			fmt.Fprintln(w, "ok")
+		}
+		fmt.Fprintf(w, "circuit: %s\n", circuit)
+	})
+
+	mux.Handle("GET /metrics", newMetricsHandler())
+
+	mux.HandleFunc("GET /vms", func(w http.ResponseWriter, r *http.Request) {
+		if apiToken != "" {
+			got := []byte(r.Header.Get("Authorization"))
+			want := []byte("Bearer " + apiToken)
+			if subtle.ConstantTimeCompare(got, want) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		health.mu.Lock()
+		latest := health.latest
+		health.mu.Unlock()
+
+		if latest == nil {
+			http.Error(w, "no VM data collected yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(latest)
+	})
+
+	return &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: mux,
+	}
+}
+
+// startHealthServer runs the health server in the background
+func startHealthServer(srv *http.Server) {
+	go func() {
+		slog.Info("Health server listening", "addr", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("Health server failed", "error", err)
+		}
+	}()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// suppressUnchanged replaces reports identical to the last one sent with a
+// heartbeat. Heartbeats are only defined for the HTTP transport.
+var suppressUnchanged bool
+
+// maxHeartbeatInterval is the longest time a full report is suppressed, so
+// the server regularly receives current data even from an idle cluster
+var maxHeartbeatInterval = time.Hour
+
+// Heartbeat is sent instead of a report that has not changed since the
+// last one sent
+type Heartbeat struct {
+	UserId      string    `json:"userId"`
+	CollectorID string    `json:"collectorId"`
+	CollectedAt time.Time `json:"collectedAt"`
+	Unchanged   bool      `json:"unchanged"`
+}
+
+// sentReport is the hash and send time of the last full report of a user
+type sentReport struct {
+	hash [sha256.Size]byte
+	at   time.Time
+}
+
+// reportKey identifies the reports of a user sent to one backend
+type reportKey struct {
+	serverURL string
+	userID    string
+}
+
+// changeTracker remembers the last full report each backend received for
+// each user, so a backend that missed a report is never sent a heartbeat
+// for it
+type changeTracker struct {
+	mu   sync.Mutex
+	last map[reportKey]sentReport
+}
+
+var sentReports = &changeTracker{last: make(map[reportKey]sentReport)}
+
+// reportHash hashes a report, leaving out the fields that change on every
+// collection regardless of the cluster's state
+func reportHash(response Response) ([sha256.Size]byte, error) {
+	response.CollectedAt = time.Time{}
+	response.CollectorStats = nil
+	data, err := json.Marshal(response)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(data), nil
+}
+
+// unchanged reports whether a report for userID with hash matches the last
+// full one serverURL received for the user within maxHeartbeatInterval
+func (t *changeTracker) unchanged(serverURL, userID string, hash [sha256.Size]byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	last, ok := t.last[reportKey{serverURL, userID}]
+	return ok && last.hash == hash && time.Since(last.at) < maxHeartbeatInterval
+}
+
+// recordSent remembers a full report for userID received by serverURL
+func (t *changeTracker) recordSent(serverURL, userID string, hash [sha256.Size]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.last[reportKey{serverURL, userID}] = sentReport{hash: hash, at: time.Now()}
+}
+
+// SendHeartbeat posts a heartbeat to the report endpoint of the backend at
+// serverURL, serialized with SCHEMA_VERSION, compressed, signed and retried
+// like a report
+func (c *Client) SendHeartbeat(ctx context.Context, serverURL string, heartbeat Heartbeat) error {
+	if c.AccessToken() == "" {
+		return errors.New("no access token available, refusing to send unauthenticated request")
+	}
+
+	data, err := marshalHeartbeat(heartbeat, schemaVersion)
+	if err != nil {
+		return err
+	}
+	_, err = c.postBody(ctx, serverURL, data, 0)
+	return err
+}
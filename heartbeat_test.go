@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestChangeTrackerPerDestination(t *testing.T) {
+	tracker := &changeTracker{last: make(map[reportKey]sentReport)}
+	hash, err := reportHash(testReport)
+	if err != nil {
+		t.Fatalf("reportHash: %v", err)
+	}
+
+	tracker.recordSent("https://primary", "user", hash)
+	if !tracker.unchanged("https://primary", "user", hash) {
+		t.Error("report received by the primary not unchanged for it")
+	}
+	if tracker.unchanged("https://mirror", "user", hash) {
+		t.Error("report never received by the mirror unchanged for it")
+	}
+	if tracker.unchanged("https://primary", "other", hash) {
+		t.Error("report unchanged for a user it was not sent for")
+	}
+
+	changed := testReport
+	changed.Vms = []VMInfo{{VMID: 101}}
+	changedHash, _ := reportHash(changed)
+	if tracker.unchanged("https://primary", "user", changedHash) {
+		t.Error("changed report unchanged")
+	}
+
+	setVar(t, &maxHeartbeatInterval, 0)
+	if tracker.unchanged("https://primary", "user", hash) {
+		t.Error("report unchanged beyond maxHeartbeatInterval")
+	}
+}
+
+func TestSendHeartbeatSchemaV2(t *testing.T) {
+	setVar(t, &schemaVersion, schemaV2)
+
+	var envelope reportEnvelope
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			t.Errorf("heartbeat is not JSON: %v", err)
+		}
+	})
+
+	heartbeat := Heartbeat{UserId: "user", CollectorID: "collector", CollectedAt: time.Now().UTC(), Unchanged: true}
+	if err := c.SendHeartbeat(context.Background(), c.ServerURL, heartbeat); err != nil {
+		t.Fatalf("SendHeartbeat: %v", err)
+	}
+	if envelope.SchemaVersion != schemaV2 || envelope.Collector.ID != "collector" {
+		t.Fatalf("heartbeat envelope = %+v, want a v2 envelope", envelope)
+	}
+	var got Heartbeat
+	if err := json.Unmarshal(envelope.Data, &got); err != nil || !got.Unchanged || got.UserId != "user" {
+		t.Errorf("heartbeat data = %s, want the heartbeat", envelope.Data)
+	}
+}
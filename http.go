@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// defaultHTTPTimeoutSeconds bounds every outbound request when
+// HTTP_TIMEOUT_SECONDS is unset
+const defaultHTTPTimeoutSeconds = 30
+
+// defaultDialTimeoutSeconds bounds establishing a connection when
+// DIAL_TIMEOUT_SECONDS is unset
+const defaultDialTimeoutSeconds = 30
+
+// Connection pool defaults used when MAX_IDLE_CONNS and
+// IDLE_CONN_TIMEOUT_SECONDS are unset
+const (
+	defaultMaxIdleConns           = 100
+	defaultIdleConnTimeoutSeconds = 90
+)
+
+// proxyFunc selects the proxy for outbound requests
+var proxyFunc = http.ProxyFromEnvironment
+
+// httpClientConfig configures the HTTP client shared by outbound requests
+type httpClientConfig struct {
+	Timeout time.Duration
+
+	// CertFile and KeyFile hold a client certificate for mutual TLS
+	CertFile string
+	KeyFile  string
+
+	// CAFile replaces the system roots used to verify servers when set
+	CAFile string
+
+	// CABundleFile adds its certificates to the roots used to verify
+	// servers, e.g. for a self-signed test backend
+	CABundleFile string
+
+	// InsecureSkipVerify disables server certificate verification. It is
+	// unsafe and only meant for development.
+	InsecureSkipVerify bool
+
+	// DialTimeout bounds establishing a connection
+	DialTimeout time.Duration
+
+	// DNSServer, as host:port, replaces the system resolver when set
+	DNSServer string
+
+	// PreferIPv6 tries the IPv6 addresses of a host before its IPv4 ones
+	PreferIPv6 bool
+
+	// MaxIdleConns bounds the idle keep-alive connections, both in total
+	// and per host
+	MaxIdleConns int
+
+	// IdleConnTimeout closes keep-alive connections idle for this long
+	IdleConnTimeout time.Duration
+}
+
+// newHTTPClient builds the HTTP client shared by all outbound requests so
+// they are configured consistently
+func newHTTPClient(cfg httpClientConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, errors.New("CLIENT_CERT_FILE and CLIENT_KEY_FILE must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CABundleFile != "" {
+		pem, err := os.ReadFile(cfg.CABundleFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+		pool := tlsConfig.RootCAs
+		if pool == nil {
+			if pool, err = x509.SystemCertPool(); err != nil {
+				pool = x509.NewCertPool()
+			}
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CABundleFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	tlsConfig.InsecureSkipVerify = cfg.InsecureSkipVerify
+
+	transport := &http.Transport{
+		// Honor HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+		Proxy:                 proxyFunc,
+		DialContext:           newDialContext(cfg),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConns,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}
+
+	return &http.Client{
+		Timeout:   cfg.Timeout,
+		Transport: transport,
+	}, nil
+}
+
+// newDialContext builds the dial function of the transport from the dial
+// timeout, resolver and address family preference
+func newDialContext(cfg httpClientConfig) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	if cfg.DNSServer != "" {
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				d := net.Dialer{Timeout: cfg.DialTimeout}
+				return d.DialContext(ctx, network, cfg.DNSServer)
+			},
+		}
+	}
+	if !cfg.PreferIPv6 {
+		return dialer.DialContext
+	}
+
+	resolver := dialer.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
+		ips, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		slices.SortStableFunc(ips, func(a, b net.IPAddr) int {
+			return boolToInt(a.IP.To4() != nil) - boolToInt(b.IP.To4() != nil)
+		})
+
+		var lastErr error
+		for _, ip := range ips {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+		return nil, lastErr
+	}
+}
+
+// parseHeaders parses a comma-separated list of Key:Value pairs
+func parseHeaders(spec string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, pair := range strings.Split(spec, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, ":")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || !httpguts.ValidHeaderFieldName(key) {
+			return nil, fmt.Errorf("invalid header %q, expected Key:Value", pair)
+		}
+		value = strings.TrimSpace(value)
+		if !httpguts.ValidHeaderFieldValue(value) {
+			return nil, fmt.Errorf("invalid value for header %q", key)
+		}
+		headers.Add(key, value)
+	}
+	return headers, nil
+}
+
+// boolToInt returns 1 for true and 0 for false
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// statusError reports a non-OK HTTP response from the server
+type statusError struct {
+	StatusCode int
+	Status     string
+
+	// RetryAfter is the wait requested by a 429 response, or 0 if none
+	RetryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return "received non-OK response: " + e.Status
+}
+
+// Is lets callers match a 401 response with errors.Is(err, errUnauthorized)
+func (e *statusError) Is(target error) bool {
+	return target == errUnauthorized && e.StatusCode == http.StatusUnauthorized
+}
+
+// maxRetryAfter caps the wait honored from a Retry-After header, so a
+// misbehaving backend cannot stall reporting indefinitely
+var maxRetryAfter = 5 * time.Minute
+
+// minRetryAfter is the least the watchdog lowers maxRetryAfter to, so that
+// Retry-After keeps being honored on short schedules
+var minRetryAfter = 30 * time.Second
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an
+// HTTP date, returning 0 when it is missing or invalid
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	var d time.Duration
+	if secs, err := strconv.Atoi(strings.TrimSpace(header)); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if at, err := http.ParseTime(header); err == nil {
+		d = at.Sub(now)
+	}
+	if d < 0 {
+		return 0
+	}
+	return min(d, maxRetryAfter)
+}
+
+// retryDelay returns the wait before the next attempt after err: the
+// backend's Retry-After when it asked for one and the exponential backoff
+// otherwise
+func retryDelay(err error, backoff time.Duration) time.Duration {
+	var se *statusError
+	if errors.As(err, &se) && se.RetryAfter > 0 {
+		return se.RetryAfter
+	}
+	return backoff
+}
+
+// statusCode returns the HTTP status code carried by err, or 0 if none
+func statusCode(err error) int {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.StatusCode
+	}
+	return 0
+}
+
+// Categories of send failures reported by classifyError
+const (
+	errorCategoryAuth              = "auth"
+	errorCategoryDNS               = "dns"
+	errorCategoryConnectionRefused = "connection-refused"
+	errorCategoryTimeout           = "timeout"
+	errorCategoryTLS               = "tls"
+	errorCategoryClient            = "4xx"
+	errorCategoryServer            = "5xx"
+	errorCategoryOther             = "other"
+)
+
+// classifyError categorizes a send failure with the given HTTP status, or 0
+// if no response was received, so operators can tell expired credentials,
+// resolver and network trouble, TLS misconfiguration and backend errors
+// apart
+func classifyError(err error, status int) string {
+	var dnsErr *net.DNSError
+	var tlsErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var netErr net.Error
+
+	switch {
+	case status == http.StatusUnauthorized, errors.Is(err, errReauthFailed), errors.Is(err, errUnauthorized):
+		return errorCategoryAuth
+	case status >= 500:
+		return errorCategoryServer
+	case status >= 400:
+		return errorCategoryClient
+	case err == nil:
+		return errorCategoryOther
+	case errors.As(err, &dnsErr):
+		return errorCategoryDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errorCategoryConnectionRefused
+	case errors.As(err, &tlsErr), errors.As(err, &recordErr), errors.As(err, new(x509.UnknownAuthorityError)), errors.As(err, new(x509.HostnameError)):
+		return errorCategoryTLS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return errorCategoryTimeout
+	default:
+		return errorCategoryOther
+	}
+}
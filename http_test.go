@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHTTPClientTimeout(t *testing.T) {
+	setVar(t, &maxRetries, 1)
+
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	httpClient, err := newHTTPClient(httpClientConfig{Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("newHTTPClient: %v", err)
+	}
+	c := NewClient(srv.URL, httpClient)
+	c.auth.set(LoginResponse{UserID: "user", AccessToken: "token"})
+
+	start := time.Now()
+	err = c.SendToServer(context.Background(), Response{UserId: "user"})
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("SendToServer error = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("SendToServer returned after %v, want about the 50ms timeout", elapsed)
+	}
+}
+
+func TestHTTPClientUsesProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+	}))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	consulted := false
+	setVar(t, &proxyFunc, func(req *http.Request) (*url.URL, error) {
+		consulted = true
+		return proxyURL, nil
+	})
+
+	httpClient, err := newHTTPClient(httpClientConfig{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("newHTTPClient: %v", err)
+	}
+	c := NewClient("http://backend.invalid", httpClient)
+	c.auth.set(LoginResponse{UserID: "user", AccessToken: "token"})
+
+	if err := c.SendToServer(context.Background(), Response{UserId: "user"}); err != nil {
+		t.Fatalf("SendToServer: %v", err)
+	}
+	if !consulted {
+		t.Error("proxyFunc was not consulted")
+	}
+	if want := "http://backend.invalid/api/vm/list"; proxied != want {
+		t.Errorf("proxy received %q, want %q", proxied, want)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	post := func(err error) error {
+		return &url.Error{Op: "Post", URL: "https://backend", Err: err}
+	}
+
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		want   string
+	}{
+		{name: "401", err: &statusError{StatusCode: 401, Status: "401 Unauthorized"}, status: 401, want: errorCategoryAuth},
+		{name: "reauth failed", err: fmt.Errorf("%w: refresh failed", errReauthFailed), want: errorCategoryAuth},
+		{name: "unauthorized", err: fmt.Errorf("refresh failed: %w", errUnauthorized), want: errorCategoryAuth},
+		{name: "503", err: &statusError{StatusCode: 503, Status: "503 Service Unavailable"}, status: 503, want: errorCategoryServer},
+		{name: "404", err: &statusError{StatusCode: 404, Status: "404 Not Found"}, status: 404, want: errorCategoryClient},
+		{name: "dns", err: post(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "backend", IsNotFound: true}}), want: errorCategoryDNS},
+		{name: "connection refused", err: post(&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), want: errorCategoryConnectionRefused},
+		{name: "unknown authority", err: post(&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}), want: errorCategoryTLS},
+		{name: "hostname", err: post(x509.HostnameError{Host: "backend"}), want: errorCategoryTLS},
+		{name: "not tls", err: post(tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}), want: errorCategoryTLS},
+		{name: "deadline", err: post(context.DeadlineExceeded), want: errorCategoryTimeout},
+		{name: "net timeout", err: post(&net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}), want: errorCategoryTimeout},
+		{name: "other", err: errors.New("marshal failed"), want: errorCategoryOther},
+		{name: "nil", want: errorCategoryOther},
+	}
+
+	for _, tt := range tests {
+		if got := classifyError(tt.err, tt.status); got != tt.want {
+			t.Errorf("%s: classifyError(%v, %d) = %q, want %q", tt.name, tt.err, tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestHTTPClientSelfSignedServer(t *testing.T) {
+	setVar(t, &maxRetries, 1)
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(bundle, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		cfg     httpClientConfig
+		wantErr bool
+	}{
+		{name: "default", wantErr: true},
+		{name: "CA_BUNDLE_FILE", cfg: httpClientConfig{CABundleFile: bundle}},
+		{name: "INSECURE_SKIP_VERIFY", cfg: httpClientConfig{InsecureSkipVerify: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Timeout = 5 * time.Second
+			httpClient, err := newHTTPClient(tt.cfg)
+			if err != nil {
+				t.Fatalf("newHTTPClient: %v", err)
+			}
+			c := NewClient(srv.URL, httpClient)
+			c.auth.set(LoginResponse{UserID: "user", AccessToken: "token"})
+
+			err = c.SendToServer(context.Background(), Response{UserId: "user"})
+			if tt.wantErr {
+				if category := classifyError(err, statusCode(err)); category != errorCategoryTLS {
+					t.Errorf("SendToServer error = %v (%s), want a TLS error", err, category)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("SendToServer: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// logFileConfig configures the rotating log file written next to stdout
+type logFileConfig struct {
+	Path       string
+	MaxSizeMB  int // Size at which the file is rotated
+	MaxBackups int // Rotated files kept, or 0 for all
+	MaxAgeDays int // Age after which rotated files are removed, or 0 for never
+}
+
+// logOutput returns stdout, teed into a rotating log file when cfg.Path is
+// set
+func logOutput(cfg logFileConfig) io.Writer {
+	if cfg.Path == "" {
+		return os.Stdout
+	}
+	return io.MultiWriter(os.Stdout, &lumberjack.Logger{
+		Filename:   cfg.Path,
+		MaxSize:    cfg.MaxSizeMB,
+		MaxBackups: cfg.MaxBackups,
+		MaxAge:     cfg.MaxAgeDays,
+	})
+}
+
+// setupLogger installs a JSON logger writing to out at the given level
+// (debug, info, warn or error), defaulting to info
+func setupLogger(level string, out io.Writer) {
+	var lvl slog.Level
+	switch strings.ToLower(level) {
+	case "debug":
+		lvl = slog.LevelDebug
+	case "", "info":
+		lvl = slog.LevelInfo
+	case "warn", "warning":
+		lvl = slog.LevelWarn
+	case "error":
+		lvl = slog.LevelError
+	default:
+		slog.SetDefault(slog.New(slog.NewJSONHandler(out, nil)))
+		fatal("Invalid LOG_LEVEL, expected debug, info, warn or error", "value", level)
+	}
+
+	slog.SetDefault(slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: lvl})))
+}
+
+// fatal logs msg at error level and exits with a non-zero status
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
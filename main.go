@@ -1,32 +1,113 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"runtime"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/robfig/cron"
+	"golang.org/x/term"
 )
 
 // VMInfo represents the information of a VM or CT
 type VMInfo struct {
-	UserID  string  `json:"userId"`
-	Name    string  `json:"name"`
-	VMID    int     `json:"vmid"`
-	Type    string  `json:"type"`
-	Status  string  `json:"status"`
-	CPU     float64 `json:"cpu"`
-	MaxCPU  int     `json:"maxcpu"`
-	Mem     float64 `json:"mem"`     // Mem in GB
-	MaxMem  float64 `json:"maxmem"`  // MaxMem in GB
-	Disk    float64 `json:"disk"`    // Disk in TB
-	MaxDisk float64 `json:"maxdisk"` // MaxDisk in TB
+	UserID  string   `json:"userId"`
+	Name    string   `json:"name"`
+	Node    string   `json:"node"`
+	Pool    string   `json:"pool"`
+	Tags    []string `json:"tags"`
+	VMID    int      `json:"vmid"`
+	Type    string   `json:"type"`
+	Status  string   `json:"status"`
+	CPU     float64  `json:"cpu"`
+	MaxCPU  int      `json:"maxcpu"`
+	Mem     float64  `json:"mem"`     // Mem in GB
+	MaxMem  float64  `json:"maxmem"`  // MaxMem in GB
+	Disk    float64  `json:"disk"`    // Disk in TB
+	MaxDisk float64  `json:"maxdisk"` // MaxDisk in TB
+
+	CPUPercent float64 `json:"cpuPercent"` // CPU as a percentage of MaxCPU
+	MemPercent float64 `json:"memPercent"` // Mem as a percentage of MaxMem
+
+	Uptime    int64 `json:"uptime"`    // Uptime in seconds
+	NetIn     int64 `json:"netin"`     // NetIn in bytes
+	NetOut    int64 `json:"netout"`    // NetOut in bytes
+	DiskRead  int64 `json:"diskread"`  // DiskRead in bytes
+	DiskWrite int64 `json:"diskwrite"` // DiskWrite in bytes
+
+	// Filled in when HUMAN_READABLE_SIZES is enabled
+	MemHuman  string `json:"memHuman,omitempty"`  // Mem formatted with a unit, e.g. "3.5 GB"
+	DiskHuman string `json:"diskHuman,omitempty"` // Disk formatted with a unit, e.g. "1.2 TB"
+
+	// Filled in by detailed collection only
+	QMPStatus string `json:"qmpStatus,omitempty"` // QEMU's own view of the guest state
+	Lock      string `json:"lock,omitempty"`      // Lock held by a running task, e.g. backup
+	HAState   string `json:"haState,omitempty"`   // HA manager state when the guest is HA managed
+	PID       int    `json:"pid,omitempty"`       // PID of the guest process on its node
+
+	// GuestAgentOK tells whether the QEMU guest agent answered, for running
+	// qemu guests when CHECK_GUEST_AGENT is enabled
+	GuestAgentOK *bool `json:"guestAgentOk,omitempty"`
+
+	// Overcommitted marks guests whose disks on a storage exceed its free
+	// space, when REPORT_STORAGE is enabled
+	Overcommitted bool `json:"overcommitted,omitempty"`
+}
+
+// NodeInfo represents the information of a physical Proxmox node
+type NodeInfo struct {
+	Node   string  `json:"node"`
+	Status string  `json:"status"`
+	CPU    float64 `json:"cpu"`
+	MaxCPU int     `json:"maxcpu"`
+	Mem    float64 `json:"mem"`    // Mem in GB
+	MaxMem float64 `json:"maxmem"` // MaxMem in GB
+	Uptime int64   `json:"uptime"` // Uptime in seconds
+}
+
+// StorageInfo represents the fill level of a storage on a node
+type StorageInfo struct {
+	Storage string  `json:"storage"`
+	Node    string  `json:"node"`
+	Type    string  `json:"type"`  // Storage plugin, e.g. dir, lvmthin or rbd
+	Used    float64 `json:"used"`  // Used in GB
+	Total   float64 `json:"total"` // Total in GB
+}
+
+// TaskInfo is a Proxmox task, such as a backup or migration, still running
+type TaskInfo struct {
+	Type      string    `json:"type"`
+	Status    string    `json:"status"`
+	Node      string    `json:"node"`
+	ID        string    `json:"id"` // ID of the object the task acts on, e.g. a VMID
+	User      string    `json:"user"`
+	StartTime time.Time `json:"startTime"`
+}
+
+// ProxmoxVersion represents the Proxmox VE version of the cluster
+type ProxmoxVersion struct {
+	Version string `json:"version"`
+	Release string `json:"release"`
 }
 
 // LoginResponse represents the response structure for login
@@ -42,186 +123,1057 @@ type LoginCredentials struct {
 	Password string `json:"password"`
 }
 
+// RefreshRequest represents the request body for refreshing the access token
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
 // Response represents the response structure
 type Response struct {
-	UserId string   `json:"userId"`
-	Vms    []VMInfo `json:"vms"`
+	UserId      string     `json:"userId"`
+	CollectorID string     `json:"collectorId"`
+	Vms         []VMInfo   `json:"vms"`
+	Nodes       []NodeInfo `json:"nodes"`
+
+	// ProxmoxVersion is the Proxmox VE version the data was collected from
+	ProxmoxVersion ProxmoxVersion `json:"proxmoxVersion"`
+
+	// CollectedAt is when the VM list was collected, encoded as RFC3339
+	CollectedAt time.Time `json:"collectedAt"`
+
+	// ClusterDegraded marks data collected while the cluster had no quorum,
+	// which may be stale or partial
+	ClusterDegraded bool `json:"clusterDegraded"`
+
+	// Tasks lists the running tasks when REPORT_TASKS is enabled
+	Tasks []TaskInfo `json:"tasks,omitempty"`
+
+	// Storage lists the storage of every node when REPORT_STORAGE is
+	// enabled
+	Storage []StorageInfo `json:"storage,omitempty"`
+
+	// Stale marks a report resent from the last snapshot because the
+	// current collection failed
+	Stale bool `json:"stale,omitempty"`
+
+	// CollectorStats describes the collector process when REPORT_SELF_STATS
+	// is enabled
+	CollectorStats *CollectorStats `json:"collectorStats,omitempty"`
 }
 
-var userID string
+// errUnauthorized is returned when the server rejects the request with 401
+var errUnauthorized = errors.New("unauthorized")
+
+// errInvalidLoginResponse is returned when a successful login or refresh
+// response lacks the identity or tokens
+var errInvalidLoginResponse = errors.New("invalid login response")
+
+// errReauthFailed is returned when the access token expired and could be
+// neither refreshed nor replaced by a fresh login
+var errReauthFailed = errors.New("reauthentication failed")
+
+// Build metadata, set with -ldflags "-X main.version=<version>
+// -X main.commit=<sha> -X main.buildDate=<date>"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// Byte multiples used to convert Proxmox byte counts
+const (
+	bytesPerMB = 1024 * 1024
+	bytesPerGB = 1024 * bytesPerMB
+	bytesPerTB = 1024 * bytesPerGB
+)
+
+// defaultReportInterval is the cron spec used when REPORT_INTERVAL is unset
+const defaultReportInterval = "*/5 * * * *"
+
+var (
+	// reportTypes lists the resource types included in reports
+	reportTypes = []string{"qemu", "lxc"}
+
+	// reportStatus restricts reports to guests in this status when set
+	reportStatus string
+
+	// excludeTemplates drops template guests from reports
+	excludeTemplates bool
+
+	// nodeFilter restricts reports to guests on this node when set
+	nodeFilter string
+
+	// compressReports gzips report bodies before sending
+	compressReports bool
+
+	// skipEmptyReports skips sending reports without guests, which the
+	// backend could read as every guest having been deleted
+	skipEmptyReports bool
+
+	// sendStaleOnError resends the last snapshot, flagged as stale, when a
+	// collection fails
+	sendStaleOnError bool
+
+	// maxStaleAge is the age beyond which a snapshot is no longer resent
+	maxStaleAge = 15 * time.Minute
+
+	// signingSecret, when set, signs report bodies with HMAC-SHA256
+	signingSecret string
+
+	// maxVMsPerRequest splits reports into batches of at most this many
+	// guests, or sends them whole when 0
+	maxVMsPerRequest int
+
+	// maxRetries is the number of attempts made to send a report
+	maxRetries = 3
+
+	// loginRetries is the number of attempts made to log in
+	loginRetries = 5
+
+	// retryBaseDelay is the delay before the first retry, doubled on each
+	// subsequent attempt
+	retryBaseDelay = time.Second
+)
 
 func main() {
-	// Load environment variables
-	err := godotenv.Load()
+	once := flag.Bool("once", false, "collect and send a single report, then exit")
+	dryRunFlag := flag.Bool("dry-run", false, "print reports to stdout instead of sending them")
+	showVersion := flag.Bool("version", false, "print build information and exit")
+	configFile := flag.String("config", "", "load configuration from a YAML or JSON file instead of .env")
+	appEnv := flag.String("env", os.Getenv("APP_ENV"), "load .env.<env> instead of .env when present (defaults to APP_ENV)")
+	diffFlag := flag.Bool("diff", false, "log the guests that changed between collections")
+	listVMs := flag.Bool("list-vms", false, "print a table of the current guests and exit without logging in")
+	validateConfig := flag.Bool("validate-config", false, "check the configuration, pvesh and the login, then exit without reporting")
+	interval := flag.Duration("interval", 0, "report at a fixed interval, e.g. 30s, instead of on a cron schedule")
+	scheduleFlag := flag.String("schedule", "", "cron spec of the report schedule, overriding REPORT_INTERVAL")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("HyperDeskClient %s (commit %s, built %s, %s)\n", version, commit, buildDate, runtime.Version())
+		return
+	}
+
+	// Cancel in-flight work when interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Load environment variables from the config file, or from the .env
+	// file of the environment when no config file is given
+	var err error
+	if *configFile != "" {
+		err = loadConfigFile(*configFile)
+	} else {
+		// Listing guests and writing reports to a file need no server
+		err = loadEnvFile(*appEnv, !*listVMs && os.Getenv("TRANSPORT") != transportFile)
+	}
+	setupLogger(os.Getenv("LOG_LEVEL"), logOutput(logFileConfig{
+		Path:       os.Getenv("LOG_FILE"),
+		MaxSizeMB:  getEnvInt("LOG_MAX_SIZE_MB", 100),
+		MaxBackups: getEnvInt("LOG_MAX_BACKUPS", 5),
+		MaxAgeDays: getEnvInt("LOG_MAX_AGE_DAYS", 30),
+	}))
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		fatal("Error loading configuration", "error", err)
+	}
+	if *interval != 0 && *scheduleFlag != "" {
+		fatal("--interval and --schedule are mutually exclusive")
+	}
+	if *interval < 0 {
+		fatal("Invalid --interval: must be positive", "value", interval.String())
 	}
 
-	// Replace with your server URL and API endpoints
+	// Replace with your server URL. SERVER_URLS lists additional backends
+	// that receive a copy of every report; the first is the primary when
+	// SERVER_URL is unset.
 	serverURL := os.Getenv("SERVER_URL")
-	loginEndpoint := serverURL + "/api/user/login"
-	vmListEndpoint := serverURL + "/api/vm/list"
+	serverURLs := getEnvList("SERVER_URLS", nil)
+	if serverURL == "" && len(serverURLs) > 0 {
+		serverURL = serverURLs[0]
+	}
 
-	// Prompt user for credentials
-	var credentials LoginCredentials
-	fmt.Print("Enter your ID: ")
-	fmt.Scanln(&credentials.ID)
-	fmt.Print("Enter your password: ")
-	fmt.Scanln(&credentials.Password)
+	// Reports written to a local file and guest listings need no server
+	transport := os.Getenv("TRANSPORT")
+	localOutput := transport == transportFile
+	if serverURL != "" || !(localOutput || *listVMs) {
+		serverURL, err = normalizeServerURL(serverURL)
+		if err != nil {
+			fatal("Invalid SERVER_URL", "error", err)
+		}
+	}
+	var mirrorURLs []string
+	for _, u := range serverURLs {
+		u, err := normalizeServerURL(u)
+		if err != nil {
+			fatal("Invalid SERVER_URLS entry", "error", err)
+		}
+		if u != serverURL && !slices.Contains(mirrorURLs, u) {
+			mirrorURLs = append(mirrorURLs, u)
+		}
+	}
+
+	httpClient, err := newHTTPClient(httpClientConfig{
+		Timeout:  time.Duration(getEnvInt("HTTP_TIMEOUT_SECONDS", defaultHTTPTimeoutSeconds)) * time.Second,
+		CertFile: os.Getenv("CLIENT_CERT_FILE"),
+		KeyFile:  os.Getenv("CLIENT_KEY_FILE"),
+		CAFile:   os.Getenv("CA_CERT_FILE"),
+
+		CABundleFile:       os.Getenv("CA_BUNDLE_FILE"),
+		InsecureSkipVerify: getEnvBool("INSECURE_SKIP_VERIFY", false),
 
-	// Login and obtain token
-	loginResp, err := login(credentials, loginEndpoint)
+		DialTimeout: time.Duration(getEnvInt("DIAL_TIMEOUT_SECONDS", defaultDialTimeoutSeconds)) * time.Second,
+		DNSServer:   os.Getenv("DNS_SERVER"),
+		PreferIPv6:  getEnvBool("PREFER_IPV6", false),
+
+		MaxIdleConns:    getEnvInt("MAX_IDLE_CONNS", defaultMaxIdleConns),
+		IdleConnTimeout: time.Duration(getEnvInt("IDLE_CONN_TIMEOUT_SECONDS", defaultIdleConnTimeoutSeconds)) * time.Second,
+	})
 	if err != nil {
-		log.Fatalf("Error logging in: %v", err)
+		fatal("Error configuring HTTP client", "error", err)
+	}
+	if getEnvBool("INSECURE_SKIP_VERIFY", false) {
+		slog.Warn("INSECURE_SKIP_VERIFY is set: TLS certificates are NOT verified and reports and credentials can be intercepted. Never use this in production.")
+	}
+	if v, ok := os.LookupEnv("API_BASE_PATH"); ok {
+		apiBasePath = normalizeBasePath(v)
+	}
+	if v := os.Getenv("PVESH_PATH"); v != "" {
+		pveshPath = v
+	}
+	pveshArgs = strings.Fields(os.Getenv("PVESH_ARGS"))
+	pveshTimeout = time.Duration(getEnvInt("PVESH_TIMEOUT_SECONDS", int(pveshTimeout/time.Second))) * time.Second
+	maxSpoolFiles = getEnvInt("MAX_SPOOL_FILES", maxSpoolFiles)
+	maxRetries = getEnvInt("MAX_RETRIES", maxRetries)
+	maxVMsPerRequest = getEnvInt("MAX_VMS_PER_REQUEST", maxVMsPerRequest)
+	maxPayloadBytes = getEnvInt("MAX_PAYLOAD_BYTES", maxPayloadBytes)
+	compressReports = getEnvBool("COMPRESS_REPORTS", compressReports)
+	signingSecret = os.Getenv("SIGNING_SECRET")
+	suppressUnchanged = getEnvBool("SUPPRESS_UNCHANGED", suppressUnchanged)
+	maxHeartbeatInterval = time.Duration(getEnvInt("MAX_HEARTBEAT_INTERVAL", int(maxHeartbeatInterval/time.Second))) * time.Second
+	sendStaleOnError = getEnvBool("SEND_STALE_ON_ERROR", sendStaleOnError)
+	maxStaleAge = time.Duration(getEnvInt("MAX_STALE_AGE_SECONDS", int(maxStaleAge/time.Second))) * time.Second
+	skipEmptyReports = getEnvBool("SKIP_EMPTY_REPORTS", skipEmptyReports)
+	logDiff = *diffFlag || getEnvBool("LOG_DIFF", logDiff)
+	diffThresholdPercent = float64(getEnvInt("DIFF_THRESHOLD_PERCENT", int(diffThresholdPercent)))
+	humanReadableSizes = getEnvBool("HUMAN_READABLE_SIZES", humanReadableSizes)
+	reportTasks = getEnvBool("REPORT_TASKS", reportTasks)
+	reportSelfStats = getEnvBool("REPORT_SELF_STATS", reportSelfStats)
+	reportStorage = getEnvBool("REPORT_STORAGE", reportStorage)
+	maxRetryAfter = time.Duration(getEnvInt("MAX_RETRY_AFTER_SECONDS", int(maxRetryAfter/time.Second))) * time.Second
+	minRetryAfter = time.Duration(getEnvInt("MIN_RETRY_AFTER_SECONDS", int(minRetryAfter/time.Second))) * time.Second
+	slowCollectionThreshold = time.Duration(getEnvInt("SLOW_COLLECTION_THRESHOLD_SECONDS", int(slowCollectionThreshold/time.Second))) * time.Second
+	floatPrecision = getEnvInt("FLOAT_PRECISION", floatPrecision)
+	if floatPrecision < 0 || floatPrecision > 15 {
+		fatal("Invalid FLOAT_PRECISION: must be between 0 and 15", "value", floatPrecision)
+	}
+	checkGuestAgent = getEnvBool("CHECK_GUEST_AGENT", checkGuestAgent)
+	checkOvercommit = getEnvBool("CHECK_OVERCOMMIT", checkOvercommit)
+	detailedCollection = getEnvBool("DETAILED_COLLECTION", detailedCollection)
+	collectionConcurrency = getEnvInt("COLLECTION_CONCURRENCY", collectionConcurrency)
+	if collectionConcurrency < 1 {
+		fatal("Invalid COLLECTION_CONCURRENCY: must be at least 1", "value", collectionConcurrency)
+	}
+	if perMinute := getEnvInt("EVENT_RATE_PER_MINUTE", defaultEventRatePerMinute); perMinute < 1 {
+		fatal("Invalid EVENT_RATE_PER_MINUTE: must be at least 1", "value", perMinute)
+	} else {
+		outOfBandLimiter = newEventLimiter(perMinute)
+	}
+	if v := os.Getenv("SCHEMA_VERSION"); v != "" {
+		if v != schemaV1 && v != schemaV2 {
+			fatal("Invalid SCHEMA_VERSION, expected v1 or v2", "value", v)
+		}
+		schemaVersion = v
+	}
+	poolUserMap, err = parsePoolUserMap(getEnvList("POOL_USER_MAP", nil))
+	if err != nil {
+		fatal("Invalid POOL_USER_MAP", "error", err)
+	}
+	reportFields = getEnvList("REPORT_FIELDS", nil)
+	for _, field := range reportFields {
+		if !slices.Contains(vmFieldNames(), field) {
+			fatal("Invalid REPORT_FIELDS entry", "value", field, "valid", strings.Join(vmFieldNames(), ","))
+		}
+	}
+	reportTypes = getEnvList("REPORT_TYPES", reportTypes)
+	reportStatus = os.Getenv("REPORT_STATUS")
+	excludeTemplates = getEnvBool("EXCLUDE_TEMPLATES", excludeTemplates)
+	nodeFilter = os.Getenv("NODE_FILTER")
+	if maxRetries < 1 {
+		fatal("Invalid MAX_RETRIES: must be at least 1", "value", maxRetries)
+	}
+	loginRetries = getEnvInt("LOGIN_RETRIES", loginRetries)
+	if loginRetries < 1 {
+		fatal("Invalid LOGIN_RETRIES: must be at least 1", "value", loginRetries)
 	}
 
-	userID = loginResp.UserID
+	if err := loadProxmoxAPIConfig(); err != nil {
+		fatal("Invalid Proxmox API configuration", "error", err)
+	}
 
-	// Start cron job to send VM list every 5 minutes
-	c := cron.New()
-	c.AddFunc("*/5 * * * *", func() {
-		vmList, err := getVMs()
+	// Fail fast if local collection is active but pvesh is unavailable
+	if _, _, ok := proxmoxAPIConfig(); !ok {
+		if _, err := exec.LookPath(pveshPath); err != nil {
+			fatal(pveshPath+" not found: run the client on a Proxmox node or set PROXMOX_API_URL and PROXMOX_API_TOKEN", "error", err)
+		}
+	}
+
+	client := NewClient(serverURL, httpClient)
+	client.Credentials = resolveCredentials
+	client.BasicAuthUser = os.Getenv("BASIC_AUTH_USER")
+	client.BasicAuthPass = os.Getenv("BASIC_AUTH_PASS")
+	client.ContentType = os.Getenv("CONTENT_TYPE")
+	client.Headers, err = parseHeaders(os.Getenv("CUSTOM_HEADERS"))
+	if err != nil {
+		fatal("Invalid CUSTOM_HEADERS", "error", err)
+	}
+	// An access token provisioned out-of-band replaces login entirely
+	staticToken := os.Getenv("ACCESS_TOKEN")
+	if staticToken != "" {
+		if os.Getenv("USER_ID") == "" {
+			fatal("ACCESS_TOKEN requires USER_ID")
+		}
+		client.UseStaticToken(os.Getenv("USER_ID"), staticToken)
+	} else if !*validateConfig {
+		client.TokenCacheFile = os.Getenv("TOKEN_CACHE_FILE")
+	}
+	client.LoadProxmoxVersion(ctx)
+
+	// Inspect the local guests without involving the server
+	if *listVMs {
+		vmList, err := client.GetVMs(ctx)
 		if err != nil {
-			log.Printf("Error getting VM list: %v", err)
-			return
+			fatal("Error getting VM list", "error", err)
+		}
+		if err := printVMTable(os.Stdout, vmList.Vms); err != nil {
+			fatal("Error printing VM list", "error", err)
+		}
+		return
+	}
+
+	// Identify this collector in reports, defaulting to the hostname
+	collectorID := os.Getenv("COLLECTOR_ID")
+	if collectorID == "" {
+		collectorID, err = os.Hostname()
+		if err != nil {
+			fatal("Error determining hostname, set COLLECTOR_ID instead", "error", err)
+		}
+	}
+
+	// Dry runs print reports locally, so no token is needed
+	dryRun := *dryRunFlag || getEnvBool("DRY_RUN", false)
+
+	// Missing or unreadable credentials are fatal at startup only; later
+	// reauthentication fails the report and is retried on the next one
+	startupCredentials := func() LoginCredentials {
+		credentials, err := client.Credentials()
+		if err != nil {
+			fatal("Error reading credentials", "error", err)
+		}
+		return credentials
+	}
+
+	// Resume a cached session or login and obtain token. Validation always
+	// performs a real login to prove the credentials work.
+	if client.StaticToken {
+		slog.Info("Using provisioned access token, skipping login", "userId", client.UserID())
+		health.recordLogin()
+	} else if localOutput {
+		// Attribute reports written to a file to USER_ID without logging in
+		client.auth.set(LoginResponse{UserID: os.Getenv("USER_ID")})
+		health.recordServerless()
+	} else if *validateConfig {
+		if _, err := client.Login(ctx, startupCredentials()); err != nil {
+			fatal("Error logging in", "error", err)
+		}
+	} else if !dryRun {
+		if client.RestoreSession(ctx) {
+			slog.Info("Resumed cached session", "file", client.TokenCacheFile)
+		} else if _, err := client.Login(ctx, startupCredentials()); err != nil {
+			fatal("Error logging in", "error", err)
+		}
+
+		health.recordLogin()
+		slog.Info("Logged in", "userId", client.UserID())
+	}
+
+	// Parse the report schedule: a fixed --interval, or a cron spec
+	// defaulting to every 5 minutes
+	var schedule cron.Schedule
+	var period time.Duration
+	var nextRun func(time.Time) time.Time // First scheduled run after a time
+	reportInterval := *scheduleFlag
+	if reportInterval == "" {
+		reportInterval = os.Getenv("REPORT_INTERVAL")
+	}
+	switch {
+	case *interval > 0:
+		reportInterval = interval.String()
+		period = *interval
+		nextRun = func(t time.Time) time.Time { return t.Add(*interval) }
+	default:
+		if reportInterval == "" {
+			reportInterval = defaultReportInterval
+		}
+		schedule, err = cron.ParseStandard(reportInterval)
+		if err != nil {
+			fatal("Invalid REPORT_INTERVAL, expected a 5-field cron spec", "value", reportInterval, "example", defaultReportInterval, "error", err)
+		}
+		next := schedule.Next(time.Now())
+		period = schedule.Next(next).Sub(next)
+		nextRun = schedule.Next
+	}
+
+	// Select the report transport, POSTing over HTTP by default
+	sendToURL := client.SendToURL
+	var stream interface{ Close() } // Streaming transport to close on exit
+	var output *fileTransport
+	switch transport {
+	case "", transportHTTP:
+	case transportWebSocket:
+		ws := newWSTransport(client)
+		sendToURL, stream = ws.SendToURL, ws
+	case transportGRPC:
+		rpc := newGRPCTransport(ctx, client)
+		sendToURL, stream = rpc.SendToURL, rpc
+	case transportFile:
+		output, err = newFileTransport(os.Getenv("OUTPUT_FILE"))
+		if err != nil {
+			fatal("Invalid file transport", "error", err)
+		}
+		stream = output
+	default:
+		fatal("Invalid TRANSPORT, expected http, websocket, grpc or file", "value", transport)
+	}
+	if suppressUnchanged && (transport == transportWebSocket || transport == transportGRPC) {
+		// The streaming protocols have no heartbeat message
+		slog.Warn("SUPPRESS_UNCHANGED is only supported by the http transport, sending every report in full", "transport", transport)
+		suppressUnchanged = false
+	}
+
+	if *validateConfig {
+		if stream != nil {
+			stream.Close()
+		}
+		slog.Info("Configuration is valid", "server", serverURL, "mirrors", len(mirrorURLs), "userId", client.UserID(), "schedule", reportInterval)
+		return
+	}
+
+	// Stop hammering a backend that keeps failing
+	breakerThreshold := getEnvInt("CIRCUIT_BREAKER_THRESHOLD", 5)
+	breakerCooldown := time.Duration(getEnvInt("CIRCUIT_BREAKER_COOLDOWN_SECONDS", 120)) * time.Second
+	breakers := make(map[string]*circuitBreaker)
+	for _, u := range append([]string{serverURL}, mirrorURLs...) {
+		breakers[u] = newCircuitBreaker(u, breakerThreshold, breakerCooldown)
+	}
+	health.breaker = breakers[serverURL]
+
+	// After this many consecutive authentication failures the session is
+	// discarded and replaced by a full login
+	authFailureThreshold := getEnvInt("AUTH_FAILURE_THRESHOLD", 3)
+	var authFailures atomic.Int32
+
+	// deliver sends a report with sendTo, refreshing the access token and
+	// retrying once if the server rejects it as unauthorized
+	deliver := func(sendTo func(context.Context, string, Response) error, serverURL string, response Response) error {
+		// Reports of other tenants keep their user across a new login
+		loggedIn := client.UserID()
+		relabel := func() {
+			if response.UserId == loggedIn {
+				response.UserId = client.UserID()
+			}
+		}
+
+		err := sendTo(ctx, serverURL, response)
+		if errors.Is(err, errUnauthorized) && client.StaticToken {
+			// ACCESS_TOKEN is only read at startup, so only a restart with a
+			// renewed token can recover
+			slog.Error("Provisioned access token rejected, restart the client with a renewed ACCESS_TOKEN", "url", serverURL)
+			return err
+		}
+		if errors.Is(err, errUnauthorized) {
+			slog.Warn("Access token rejected, reauthenticating", "url", serverURL)
+			err = client.Reauthenticate(ctx)
+			if err != nil {
+				err = fmt.Errorf("%w: %v", errReauthFailed, err)
+			} else {
+				slog.Info("Reauthenticated, retrying send", "url", serverURL)
+				relabel()
+				err = sendTo(ctx, serverURL, response)
+			}
+		}
+
+		if !errors.Is(err, errReauthFailed) && !errors.Is(err, errUnauthorized) {
+			authFailures.Store(0)
+			return err
+		}
+		failures := authFailures.Add(1)
+		if authFailureThreshold <= 0 || int(failures) < authFailureThreshold {
+			return err
+		}
+
+		slog.Warn("Repeated authentication failures, discarding session and logging in again", "failures", failures)
+		if err := client.ResetSession(ctx); err != nil {
+			return fmt.Errorf("%w: %v", errReauthFailed, err)
+		}
+		authFailures.Store(0)
+		slog.Info("Recovered session with a fresh login", "userId", client.UserID())
+		relabel()
+		return sendTo(ctx, serverURL, response)
+	}
+
+	// sendHeartbeat sends the heartbeat standing in for an unchanged report
+	sendHeartbeat := func(ctx context.Context, serverURL string, response Response) error {
+		return client.SendHeartbeat(ctx, serverURL, Heartbeat{UserId: response.UserId, CollectorID: response.CollectorID, CollectedAt: response.CollectedAt, Unchanged: true})
+	}
+
+	// sendVia delivers a report with sendTo unless the backend's circuit
+	// breaker is open
+	sendVia := func(sendTo func(context.Context, string, Response) error, serverURL string, response Response) error {
+		breaker := breakers[serverURL]
+		if !breaker.allow() {
+			return errCircuitOpen
+		}
+		err := deliver(sendTo, serverURL, response)
+		// An oversized report says nothing about the backend's health
+		if errors.Is(err, errPayloadTooLarge) {
+			breaker.release()
+		} else {
+			breaker.record(err)
+		}
+		return err
+	}
+	send := func(serverURL string, response Response) error {
+		return sendVia(sendToURL, serverURL, response)
+	}
+
+	// sendFull delivers a full report to u and remembers it was received
+	sendFull := func(u string, response Response) error {
+		hash, err := reportHash(response)
+		if err != nil {
+			return err
+		}
+		if err := send(u, response); err != nil {
+			return err
+		}
+		sentReports.recordSent(u, response.UserId, hash)
+		return nil
+	}
+
+	// sendReport delivers a report to u, replacing it with a heartbeat when
+	// the last full report u received for the user was identical
+	sendReport := func(u string, response Response) error {
+		hash, err := reportHash(response)
+		if err != nil {
+			return err
+		}
+		if !suppressUnchanged || !sentReports.unchanged(u, response.UserId, hash) {
+			return sendFull(u, response)
+		}
+		if err := sendVia(sendHeartbeat, u, response); err != nil {
+			return err
+		}
+		slog.Info("Report unchanged, sent heartbeat", "url", u, "userId", response.UserId)
+		return nil
+	}
+	sendSpooled := func(response Response) error {
+		return sendFull(serverURL, response)
+	}
+
+	// publishOne delivers a report to every backend concurrently. The
+	// primary also receives any spooled reports first and spools this one in
+	// turn if delivery fails.
+	publishOne := func(response Response) error {
+		if dryRun {
+			data, err := json.MarshalIndent(response, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
+			return nil
+		}
+
+		if skipEmptyReport(response) {
+			slog.Warn("No guests collected, skipping report")
+			return nil
+		}
+
+		if output != nil {
+			if err := output.Write(response); err != nil {
+				return err
+			}
+			health.recordSend(len(response.Vms))
+			slog.Info("Report written", "file", os.Getenv("OUTPUT_FILE"), "vms", len(response.Vms))
+			return nil
+		}
+
+		var mirrors sync.WaitGroup
+		mirrorErrs := make([]error, len(mirrorURLs))
+		for i, mirrorURL := range mirrorURLs {
+			mirrors.Add(1)
+			go func() {
+				defer mirrors.Done()
+				if err := sendReport(mirrorURL, response); err != nil {
+					slog.Error("Error sending VM list to server", "url", mirrorURL, "error", err, "status", statusCode(err), "vms", len(response.Vms))
+					mirrorErrs[i] = fmt.Errorf("%s: %w", mirrorURL, err)
+				}
+			}()
+		}
+
+		// Deliver any reports spooled during earlier failures first
+		err := drainSpool(sendSpooled)
+		if err == nil {
+			err = sendReport(serverURL, response)
+		}
+		if errors.Is(err, errCircuitOpen) {
+			slog.Warn("Circuit breaker open, spooling report", "url", serverURL, "vms", len(response.Vms))
+			if err := spoolReport(response); err != nil {
+				slog.Error("Error spooling VM list", "error", err)
+			}
+		} else if errors.Is(err, errPayloadTooLarge) {
+			// Spooling is pointless, the report would never fit
+			health.recordFailure()
+		} else if err != nil {
+			slog.Error("Error sending VM list to server", "url", serverURL, "error", err, "status", statusCode(err), "vms", len(response.Vms))
+			health.recordFailure()
+			if err := spoolReport(response); err != nil {
+				slog.Error("Error spooling VM list", "error", err)
+			}
+		} else {
+			health.recordSend(len(response.Vms))
+		}
+
+		mirrors.Wait()
+		if err != nil {
+			err = fmt.Errorf("%s: %w", serverURL, err)
+		}
+		return errors.Join(append([]error{err}, mirrorErrs...)...)
+	}
+
+	// publish delivers a report, split into one report per user when
+	// POOL_USER_MAP attributes guests to several users
+	publish := func(response Response) error {
+		var errs []error
+		for _, report := range splitByUser(response) {
+			errs = append(errs, publishOne(report))
+		}
+		return errors.Join(errs...)
+	}
+
+	// report collects the VM list and publishes it, falling back to the
+	// last snapshot when collection fails and SEND_STALE_ON_ERROR allows
+	report := func() error {
+		collectStart := time.Now()
+		vmList, err := client.GetVMs(ctx)
+		observeCollection(time.Since(collectStart))
+		if err != nil {
+			stale := health.snapshot()
+			if !sendStaleOnError || stale == nil || time.Since(stale.CollectedAt) > maxStaleAge {
+				return fmt.Errorf("error getting VM list: %v", err)
+			}
+			slog.Warn("Error getting VM list, sending last snapshot", "error", err, "collectedAt", stale.CollectedAt)
+			response := *stale
+			response.Stale = true
+			response.UserId = client.UserID()
+			return publish(response)
 		}
 
 		response := Response{
-			UserId: userID,
-			Vms:    vmList.Vms,
+			UserId:      client.UserID(),
+			CollectorID: collectorID,
+			Vms:         vmList.Vms,
+			Nodes:       vmList.Nodes,
+			CollectedAt: vmList.CollectedAt,
+
+			ProxmoxVersion:  vmList.ProxmoxVersion,
+			ClusterDegraded: vmList.ClusterDegraded,
+			Tasks:           vmList.Tasks,
+			Storage:         vmList.Storage,
+		}
+		if reportSelfStats {
+			response.CollectorStats = collectorStats()
 		}
+		previous := health.snapshot()
+		health.recordSnapshot(response)
+		if logDiff {
+			logVMDiff(previous, &response)
+		}
+
+		if !dryRun && !localOutput {
+			// Report status changes ahead of the regular report
+			events := statusChanges(previous, &response)
+			if sent, err := client.SendEvents(ctx, EventReport{UserId: client.UserID(), CollectorID: collectorID, Events: events}); err != nil {
+				slog.Warn("Error sending status events", "events", sent, "error", err)
+			} else if sent > 0 {
+				slog.Info("Status events sent", "events", sent)
+			}
+		}
+
+		return publish(response)
+	}
 
-		err = sendToServer(response, vmListEndpoint)
+	// In one-shot mode report once and exit with a meaningful status
+	if *once || getEnvBool("RUN_ONCE", false) {
+		err := report()
+		if stream != nil {
+			stream.Close()
+		}
 		if err != nil {
-			log.Printf("Error sending VM list to server: %v", err)
+			fatal("Report failed", "error", err)
 		}
+		os.Exit(0)
+	}
+
+	// Expose health and metrics, allowing two report intervals between sends
+	healthServer := newHealthServer(getEnvInt("HEALTH_PORT", defaultHealthPort), period, os.Getenv("LOCAL_API_TOKEN"))
+	startHealthServer(healthServer)
+
+	// Serve profiles on the loopback interfaces only
+	enablePprof = getEnvBool("ENABLE_PPROF", enablePprof)
+	var pprofServers []*http.Server
+	if enablePprof {
+		pprofServers = newPprofServers(getEnvInt("PPROF_PORT", defaultPprofPort))
+		startPprofServers(pprofServers)
+	}
+
+	// Track in-flight reports so shutdown can wait for them. No report
+	// starts once stopping is set, so wg.Add never races with wg.Wait.
+	var wg sync.WaitGroup
+	var jobsMu sync.Mutex
+	stopping := false
+	watch := newWatchdog()
+
+	// Start cron job to send VM list on the configured schedule. Cron starts
+	// every run in its own goroutine, so runs starting while a report is
+	// still running are skipped.
+	job := skipOverlapping(func() {
+		jobsMu.Lock()
+		if stopping {
+			jobsMu.Unlock()
+			return
+		}
+		wg.Add(1)
+		jobsMu.Unlock()
+		defer wg.Done()
+
+		if err := report(); err != nil {
+			slog.Error("Report failed", "error", err)
+		}
+		watch.touch()
 	})
-	c.Start()
 
-	// Keep the program running
-	select {}
-}
+	// Execute lifecycle commands relayed by the backend
+	if getEnvBool("ENABLE_COMMANDS", false) && !dryRun && !localOutput {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.RunCommandLoop(ctx)
+		}()
+	}
 
-// login sends a login request to the server and returns the access token
-func login(credentials LoginCredentials, loginEndpoint string) (*LoginResponse, error) {
-	// Convert credentials to JSON
-	body, err := json.Marshal(credentials)
-	if err != nil {
-		return nil, err
+	// Spread scheduled runs of a fleet of collectors over the jitter window
+	maxJitter := time.Duration(getEnvInt("REPORT_JITTER_SECONDS", 0)) * time.Second
+	jitter := newJitter()
+
+	scheduled := func() {
+		if err := sleepContext(ctx, jitter.next(maxJitter)); err != nil {
+			return
+		}
+		job()
 	}
 
-	// Send POST request to login endpoint
-	resp, err := http.Post(loginEndpoint, "application/json", bytes.NewBuffer(body))
-	if err != nil {
-		return nil, fmt.Errorf("login request failed: %v", err)
+	// Exit when no report completes by the grace period past the second
+	// scheduled run after the last one, or never when
+	// WATCHDOG_GRACE_SECONDS is negative. A report has at least the
+	// shortest schedule gap plus the grace period to finish, so Retry-After
+	// waits are capped to let all retries of a send fit in it, though never
+	// below MIN_RETRY_AFTER_SECONDS. The deadline is extended when that
+	// minimum does not fit.
+	if grace := getEnvInt("WATCHDOG_GRACE_SECONDS", defaultWatchdogGraceSeconds); grace >= 0 {
+		budget := shortestGap(nextRun, time.Now()) + time.Duration(grace)*time.Second
+		if capped := capRetryAfter(maxRetryAfter, minRetryAfter, budget, maxRetries); capped < maxRetryAfter {
+			slog.Warn("Lowering MAX_RETRY_AFTER_SECONDS so retries finish before the watchdog deadline", "configured", maxRetryAfter.String(), "capped", capped.String())
+			maxRetryAfter = capped
+		}
+		slack := maxJitter + time.Duration(grace)*time.Second + max(0, time.Duration(maxRetries)*maxRetryAfter-budget)
+		go watch.run(ctx, nextRun, slack)
 	}
-	defer resp.Body.Close()
 
-	// Check response status code
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("login failed with status code: %d", resp.StatusCode)
+	// Run scheduled reports on a ticker for --interval and with cron
+	// otherwise. The ticker drops ticks due while a report is running.
+	var stopSchedule func()
+	if *interval > 0 {
+		ticker := time.NewTicker(*interval)
+		stopSchedule = ticker.Stop
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					scheduled()
+				}
+			}
+		}()
+	} else {
+		c := cron.New()
+		c.Schedule(schedule, cron.FuncJob(scheduled))
+		c.Start()
+		stopSchedule = c.Stop
 	}
 
-	// Parse response body
-	var loginResp LoginResponse
-	err = json.NewDecoder(resp.Body).Decode(&loginResp)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode login response: %v", err)
+	// Report immediately rather than waiting a full interval
+	if !getEnvBool("SKIP_INITIAL_REPORT", false) {
+		job()
+	}
+
+	// Keep the program running until interrupted
+	<-ctx.Done()
+
+	// Stop scheduling new reports and wait for the current one, which the
+	// cancelled context aborts, to finish
+	slog.Info("Shutting down")
+	stopSchedule()
+	jobsMu.Lock()
+	stopping = true
+	jobsMu.Unlock()
+	wg.Wait()
+	if stream != nil {
+		stream.Close()
 	}
 
-	return &loginResp, nil
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := healthServer.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Error shutting down health server", "error", err)
+	}
+	for _, srv := range pprofServers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Error shutting down pprof server", "addr", srv.Addr, "error", err)
+		}
+	}
+	slog.Info("Shutdown complete")
+	os.Exit(0)
 }
 
-// getVMs retrieves VM information from Proxmox VE
-func getVMs() (*Response, error) {
-	// Execute pvesh command to get VM list
-	cmd := exec.Command("pvesh", "get", "/cluster/resources", "--output-format", "json")
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("failed to execute pvesh command: %v", err)
-	}
-
-	// Parse the JSON output
-	var resources struct {
-		Data []struct {
-			Name    string  `json:"name"`
-			Type    string  `json:"type"`
-			Status  string  `json:"status"`
-			CPU     float64 `json:"cpu"`
-			MaxCPU  int     `json:"maxcpu"`
-			Mem     float64 `json:"mem"`
-			MaxMem  float64 `json:"maxmem"`
-			Disk    float64 `json:"disk"`
-			MaxDisk float64 `json:"maxdisk"`
-			VMID    int     `json:"vmid"`
-		} `json:"data"`
-	}
-
-	err = json.Unmarshal(output, &resources)
-	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal JSON: %v", err)
+// jitter produces random delays from a seeded source that is safe for use
+// by concurrent cron runs
+type jitter struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func newJitter() *jitter {
+	return &jitter{rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// next returns a random delay between 0 and max
+func (j *jitter) next(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
 	}
 
-	// Convert to the desired structure
-	vms := make([]VMInfo, 0)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return time.Duration(j.rng.Int63n(int64(max) + 1))
+}
 
-	for _, res := range resources.Data {
-		vm := VMInfo{
-			UserID:  userID,
-			Name:    res.Name,
-			VMID:    res.VMID,
-			Type:    res.Type,
-			Status:  res.Status,
-			CPU:     res.CPU,
-			MaxCPU:  res.MaxCPU,
-			Mem:     float64(res.Mem) / (1024 * 1024),            // Convert from MB to GB
-			MaxMem:  float64(res.MaxMem) / (1024 * 1024),         // Convert from MB to GB
-			Disk:    float64(res.Disk) / (1024 * 1024 * 1024),    // Convert from GB to TB
-			MaxDisk: float64(res.MaxDisk) / (1024 * 1024 * 1024), // Convert from GB to TB
+// skipOverlapping returns fn guarded so that a call made while a previous
+// one is still running returns at once instead of running fn concurrently
+func skipOverlapping(fn func()) func() {
+	var running sync.Mutex
+	return func() {
+		if !running.TryLock() {
+			slog.Warn("Skipping scheduled report, the previous one is still running")
+			return
 		}
+		defer running.Unlock()
+		fn()
+	}
+}
 
-		// Round to two decimal places
-		vm.Mem, _ = strconv.ParseFloat(fmt.Sprintf("%.2f", vm.Mem), 64)
-		vm.MaxMem, _ = strconv.ParseFloat(fmt.Sprintf("%.2f", vm.MaxMem), 64)
-		vm.Disk, _ = strconv.ParseFloat(fmt.Sprintf("%.2f", vm.Disk), 64)
-		vm.MaxDisk, _ = strconv.ParseFloat(fmt.Sprintf("%.2f", vm.MaxDisk), 64)
+// loadEnvFile loads .env.<appEnv> when appEnv is set and the file exists,
+// and .env otherwise. Running without either file is fine as long as the
+// server URL is already in the environment or requireServer is false.
+func loadEnvFile(appEnv string, requireServer bool) error {
+	files := []string{".env"}
+	if appEnv != "" {
+		files = slices.Insert(files, 0, ".env."+appEnv)
+	}
 
-		if res.Type == "qemu" || res.Type == "lxc" {
-			vms = append(vms, vm)
+	for _, file := range files {
+		err := godotenv.Load(file)
+		if err == nil || !errors.Is(err, os.ErrNotExist) {
+			return err
 		}
 	}
 
-	response := &Response{
-		UserId: userID,
-		Vms:    vms,
+	if requireServer && os.Getenv("SERVER_URL") == "" && os.Getenv("SERVER_URLS") == "" {
+		return fmt.Errorf("none of %s found and SERVER_URL is not set in the environment", strings.Join(files, ", "))
 	}
+	return nil
+}
 
-	return response, nil
+// skipEmptyReport reports whether response is skipped for holding no
+// guests, which only happens with SKIP_EMPTY_REPORTS
+func skipEmptyReport(response Response) bool {
+	return skipEmptyReports && len(response.Vms) == 0
 }
 
-// sendToServer sends the VM list to the server
-func sendToServer(vmList Response, serverURL string) error {
-	data, err := json.Marshal(vmList)
+// printVMTable writes guests to w as a human-readable table
+func printVMTable(w io.Writer, vms []VMInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VMID\tNAME\tTYPE\tSTATUS\tNODE\tCPU%\tMEM (GB)")
+	for _, vm := range vms {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%.2f\t%.2f/%.2f\n", vm.VMID, vm.Name, vm.Type, vm.Status, vm.Node, vm.CPUPercent, vm.Mem, vm.MaxMem)
+	}
+	return tw.Flush()
+}
+
+// normalizeBasePath gives a path prefix a single leading slash and no
+// trailing one, so "hyperdesk/api/" becomes "/hyperdesk/api" and "/" the
+// empty prefix of an API at the server root
+func normalizeBasePath(path string) string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return ""
+	}
+	return "/" + path
+}
+
+// normalizeServerURL checks that raw is an absolute http or https URL and
+// strips any trailing slash so endpoint paths can be appended to it
+func normalizeServerURL(raw string) (string, error) {
+	if raw == "" {
+		return "", errors.New("server URL is empty")
+	}
+
+	u, err := url.Parse(raw)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("failed to parse server URL %q: %v", raw, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("server URL %q must start with http:// or https://", raw)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("server URL %q has no host", raw)
+	}
+
+	return strings.TrimRight(raw, "/"), nil
+}
+
+// resolveCredentials reads the credentials from USER_ID and USER_PASSWORD,
+// prompting for them only when both are unset and stdin is a terminal.
+// USER_PASSWORD_FILE, e.g. a Docker secret or systemd credential, takes
+// precedence over USER_PASSWORD and is read on every login so rotated
+// secrets are picked up.
+func resolveCredentials() (LoginCredentials, error) {
+	credentials := LoginCredentials{
+		ID:       os.Getenv("USER_ID"),
+		Password: os.Getenv("USER_PASSWORD"),
+	}
+	if passwordFile := os.Getenv("USER_PASSWORD_FILE"); passwordFile != "" {
+		data, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return LoginCredentials{}, fmt.Errorf("failed to read USER_PASSWORD_FILE: %v", err)
+		}
+		credentials.Password = strings.TrimSpace(string(data))
+		if credentials.Password == "" {
+			return LoginCredentials{}, fmt.Errorf("USER_PASSWORD_FILE %s is empty", passwordFile)
+		}
+	}
+	if credentials.ID != "" && credentials.Password != "" {
+		return credentials, nil
+	}
+	if credentials.ID != "" || credentials.Password != "" {
+		return LoginCredentials{}, errors.New("USER_ID and USER_PASSWORD must be set together")
 	}
 
-	req, err := http.NewRequest("POST", serverURL, bytes.NewBuffer(data))
+	if !stdinIsTerminal() {
+		return LoginCredentials{}, errors.New("no credentials available: set USER_ID and USER_PASSWORD when running without a terminal")
+	}
+
+	return promptCredentials()
+}
+
+// stdinIsTerminal reports whether stdin is attached to a terminal
+func stdinIsTerminal() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// promptCredentials asks the user for their ID and password
+func promptCredentials() (LoginCredentials, error) {
+	var credentials LoginCredentials
+	fmt.Print("Enter your ID: ")
+	fmt.Scanln(&credentials.ID)
+	fmt.Print("Enter your password: ")
+	password, err := readPassword()
 	if err != nil {
-		return err
+		return LoginCredentials{}, fmt.Errorf("failed to read password: %v", err)
+	}
+	credentials.Password = password
+	return credentials, nil
+}
+
+// readPassword reads a password from stdin without echoing it when stdin is
+// a terminal, falling back to a plain read otherwise
+func readPassword() (string, error) {
+	if !stdinIsTerminal() {
+		var password string
+		fmt.Scanln(&password)
+		return password, nil
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer resp.Body.Close()
+	return string(password), nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("received non-OK response: %s", resp.Status)
+// getEnvInt reads an integer environment variable, returning def when unset
+func getEnvInt(key string, def int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
 	}
 
-	return nil
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		fatal("Invalid integer environment variable", "key", key, "value", value)
+	}
+
+	return n
+}
+
+// getEnvBool reads a boolean environment variable, returning def when unset
+func getEnvBool(key string, def bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		fatal("Invalid boolean environment variable", "key", key, "value", value)
+	}
+
+	return b
+}
+
+// getEnvList reads a comma-separated environment variable, returning def
+// when unset
+func getEnvList(key string, def []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
 }
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNormalizeServerURL(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{raw: "example.com", wantErr: true},
+		{raw: "https://host/", want: "https://host"},
+		{raw: "http://host:8080/base//", want: "http://host:8080/base"},
+		{raw: "https://host", want: "https://host"},
+		{raw: "ftp://host", wantErr: true},
+		{raw: "https://", wantErr: true},
+		{raw: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := normalizeServerURL(tt.raw)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("normalizeServerURL(%q) = %q, want an error", tt.raw, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("normalizeServerURL(%q) = %q, %v, want %q", tt.raw, got, err, tt.want)
+		}
+	}
+}
+
+func TestSkipEmptyReport(t *testing.T) {
+	empty := Response{UserId: "user", Vms: []VMInfo{}}
+	full := Response{UserId: "user", Vms: []VMInfo{{VMID: 100}}}
+
+	setVar(t, &skipEmptyReports, true)
+	if !skipEmptyReport(empty) {
+		t.Error("empty report sent with SKIP_EMPTY_REPORTS")
+	}
+	if skipEmptyReport(full) {
+		t.Error("report with guests skipped with SKIP_EMPTY_REPORTS")
+	}
+
+	setVar(t, &skipEmptyReports, false)
+	if skipEmptyReport(empty) {
+		t.Error("empty report skipped without SKIP_EMPTY_REPORTS")
+	}
+}
+
+func TestSendEmptyReport(t *testing.T) {
+	var body map[string]json.RawMessage
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Errorf("report is not JSON: %v", err)
+		}
+	})
+
+	if err := c.SendToServer(context.Background(), Response{UserId: "user", Vms: []VMInfo{}}); err != nil {
+		t.Fatalf("SendToServer: %v", err)
+	}
+	if got := string(body["vms"]); got != "[]" {
+		t.Errorf("vms = %s, want an empty array", got)
+	}
+}
+
+func TestSkipOverlapping(t *testing.T) {
+	var runs atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	job := skipOverlapping(func() {
+		runs.Add(1)
+		started <- struct{}{}
+		<-release
+	})
+
+	// Start a slow run, then overlap it as cron does from another goroutine
+	done := make(chan struct{})
+	go func() {
+		job()
+		close(done)
+	}()
+	<-started
+
+	overlapped := make(chan struct{})
+	go func() {
+		job()
+		close(overlapped)
+	}()
+	select {
+	case <-overlapped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("run overlapping a slow one did not return")
+	}
+	if n := runs.Load(); n != 1 {
+		t.Errorf("%d runs while the slow one was running, want 1", n)
+	}
+
+	close(release)
+	<-done
+	go func() { <-started }()
+	job()
+	if n := runs.Load(); n != 2 {
+		t.Errorf("%d runs after the slow one finished, want 2", n)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// vmLabels are the labels of every per-VM gauge
+var vmLabels = []string{"vmid", "name", "type", "node"}
+
+var (
+	vmCPUDesc     = prometheus.NewDesc("hyperdesk_vm_cpu", "CPU usage of the guest as a fraction of its cores.", vmLabels, nil)
+	vmMaxCPUDesc  = prometheus.NewDesc("hyperdesk_vm_maxcpu", "Number of CPU cores of the guest.", vmLabels, nil)
+	vmMemDesc     = prometheus.NewDesc("hyperdesk_vm_mem_gb", "Memory used by the guest in GB.", vmLabels, nil)
+	vmMaxMemDesc  = prometheus.NewDesc("hyperdesk_vm_maxmem_gb", "Memory of the guest in GB.", vmLabels, nil)
+	vmDiskDesc    = prometheus.NewDesc("hyperdesk_vm_disk_tb", "Disk used by the guest in TB.", vmLabels, nil)
+	vmMaxDiskDesc = prometheus.NewDesc("hyperdesk_vm_maxdisk_tb", "Disk size of the guest in TB.", vmLabels, nil)
+	vmUptimeDesc  = prometheus.NewDesc("hyperdesk_vm_uptime_seconds", "Uptime of the guest in seconds.", vmLabels, nil)
+)
+
+// collectionDuration records how long each collection of the guest list
+// takes, so delayed reports can be matched to a slow Proxmox API
+var collectionDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "hyperdesk_collection_duration_seconds",
+	Help:    "Time taken to collect the guest list.",
+	Buckets: prometheus.ExponentialBuckets(0.25, 2, 10),
+})
+
+// slowCollectionThreshold is the collection time above which a warning is
+// logged, or 0 to never warn
+var slowCollectionThreshold = 10 * time.Second
+
+// observeCollection records the duration of a collection and warns when it
+// exceeds slowCollectionThreshold
+func observeCollection(d time.Duration) {
+	collectionDuration.Observe(d.Seconds())
+	if slowCollectionThreshold > 0 && d > slowCollectionThreshold {
+		slog.Warn("Slow guest collection", "duration", d.String(), "threshold", slowCollectionThreshold.String())
+	}
+}
+
+// vmCollector exposes the guests of the latest snapshot as gauges, so
+// scrapes always reflect the most recent collection
+type vmCollector struct{}
+
+func (vmCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{vmCPUDesc, vmMaxCPUDesc, vmMemDesc, vmMaxMemDesc, vmDiskDesc, vmMaxDiskDesc, vmUptimeDesc} {
+		ch <- desc
+	}
+}
+
+func (vmCollector) Collect(ch chan<- prometheus.Metric) {
+	health.mu.Lock()
+	latest := health.latest
+	health.mu.Unlock()
+
+	if latest == nil {
+		return
+	}
+	for _, vm := range latest.Vms {
+		labels := []string{strconv.Itoa(vm.VMID), vm.Name, vm.Type, vm.Node}
+		ch <- prometheus.MustNewConstMetric(vmCPUDesc, prometheus.GaugeValue, vm.CPU, labels...)
+		ch <- prometheus.MustNewConstMetric(vmMaxCPUDesc, prometheus.GaugeValue, float64(vm.MaxCPU), labels...)
+		ch <- prometheus.MustNewConstMetric(vmMemDesc, prometheus.GaugeValue, vm.Mem, labels...)
+		ch <- prometheus.MustNewConstMetric(vmMaxMemDesc, prometheus.GaugeValue, vm.MaxMem, labels...)
+		ch <- prometheus.MustNewConstMetric(vmDiskDesc, prometheus.GaugeValue, vm.Disk, labels...)
+		ch <- prometheus.MustNewConstMetric(vmMaxDiskDesc, prometheus.GaugeValue, vm.MaxDisk, labels...)
+		ch <- prometheus.MustNewConstMetric(vmUptimeDesc, prometheus.GaugeValue, float64(vm.Uptime), labels...)
+	}
+}
+
+// healthValue reads a collector statistic under the health lock
+func healthValue(read func(h *healthState) float64) func() float64 {
+	return func() float64 {
+		health.mu.Lock()
+		defer health.mu.Unlock()
+		return read(health)
+	}
+}
+
+// newMetricsHandler serves the collector statistics and the per-VM gauges
+// in the Prometheus text format
+func newMetricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "reports_sent_total",
+			Help: "Reports delivered to the primary server.",
+		}, healthValue(func(h *healthState) float64 { return float64(h.reportsSent) })),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "send_failures_total",
+			Help: "Reports that could not be delivered to the primary server.",
+		}, healthValue(func(h *healthState) float64 { return float64(h.sendFailures) })),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "last_vm_count",
+			Help: "Number of guests in the last delivered report.",
+		}, healthValue(func(h *healthState) float64 { return float64(h.lastVMCount) })),
+		collectionDuration,
+		vmCollector{},
+	)
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
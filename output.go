@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// transportFile appends reports to a local file instead of sending them
+const transportFile = "file"
+
+// fileTransport appends every report as one line of JSON to a file, for
+// deployments where a sidecar ships the file. Reports carry the same payload
+// as the HTTP transport's POST bodies.
+type fileTransport struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// newFileTransport opens path for appending, creating it if needed
+func newFileTransport(path string) (*fileTransport, error) {
+	if path == "" {
+		return nil, errors.New("OUTPUT_FILE is required with TRANSPORT=file")
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open OUTPUT_FILE: %v", err)
+	}
+	return &fileTransport{file: file}, nil
+}
+
+// Write appends the report as a line of JSON and flushes it to disk, so
+// readers never see a partial cycle
+func (t *fileTransport) Write(vmList Response) error {
+	data, err := marshalReport(vmList, schemaVersion)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, err := t.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write report to %s: %v", t.file.Name(), err)
+	}
+	return t.file.Sync()
+}
+
+// Close closes the file
+func (t *fileTransport) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.file.Close()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// guestDiskKey matches the guest config keys holding disks and mount points
+var guestDiskKey = regexp.MustCompile(`^((ide|sata|scsi|virtio|unused|mp)\d+|rootfs|efidisk0|tpmstate0)$`)
+
+// markOvercommitted flags the guests whose disks on a storage are larger
+// than the free space left on it, which thin-provisioned storage allows but
+// cannot back once the disks fill up. free holds the free bytes by
+// node/storage. The disks of a guest are read from its config, so guests
+// whose config cannot be read are left unflagged.
+func (c *Client) markOvercommitted(ctx context.Context, vms []VMInfo, free map[string]int64) {
+	forEachGuest(ctx, vms, func(vm *VMInfo) {
+		path := fmt.Sprintf("/nodes/%s/%s/%d/config", url.PathEscape(vm.Node), vm.Type, vm.VMID)
+		output, err := c.proxmoxGet(ctx, path)
+		if err != nil {
+			slog.Warn("Error fetching guest config", "vmid", vm.VMID, "node", vm.Node, "error", err)
+			return
+		}
+
+		// Accept the result both bare and wrapped in "data"
+		var config map[string]any
+		if err := json.Unmarshal(output, &config); err != nil {
+			slog.Warn("Error decoding guest config", "vmid", vm.VMID, "node", vm.Node, "error", err)
+			return
+		}
+		if data, ok := config["data"].(map[string]any); ok {
+			config = data
+		}
+
+		for name, size := range guestDiskSizes(config) {
+			if f, ok := free[vm.Node+"/"+name]; ok && size > f {
+				vm.Overcommitted = true
+			}
+		}
+	})
+}
+
+// guestDiskSizes sums the sizes of the disks in a guest config by storage.
+// CD-ROMs, passthrough devices and disks without a size are skipped.
+func guestDiskSizes(config map[string]any) map[string]int64 {
+	sizes := make(map[string]int64)
+	for key, value := range config {
+		spec, ok := value.(string)
+		if !ok || !guestDiskKey.MatchString(key) {
+			continue
+		}
+
+		options := strings.Split(spec, ",")
+		name, _, ok := strings.Cut(options[0], ":")
+		if !ok || strings.HasPrefix(options[0], "/") {
+			continue
+		}
+
+		var size int64
+		cdrom := false
+		for _, option := range options[1:] {
+			k, v, _ := strings.Cut(option, "=")
+			switch k {
+			case "media":
+				cdrom = v == "cdrom"
+			case "size":
+				size = parseDiskSize(v)
+			}
+		}
+		if !cdrom && size > 0 {
+			sizes[name] += size
+		}
+	}
+	return sizes
+}
+
+// parseDiskSize parses a Proxmox disk size such as 32G or 512M, in bytes
+// when it has no unit, returning 0 when it is invalid
+func parseDiskSize(s string) int64 {
+	multiplier := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			s = s[:n-1]
+		}
+	}
+
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 {
+		return 0
+	}
+	return int64(value * float64(multiplier))
+}
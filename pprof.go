@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+)
+
+// defaultPprofPort is the port of the pprof server when PPROF_PORT is unset
+const defaultPprofPort = 6060
+
+// enablePprof serves the pprof profiles on the loopback interfaces
+var enablePprof bool
+
+// newPprofServers builds the servers exposing /debug/pprof/ on port of the
+// IPv4 and IPv6 loopback addresses. Profiles expose internals of the
+// process, so they are never reachable from other hosts.
+func newPprofServers(port int) []*http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	var servers []*http.Server
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		servers = append(servers, &http.Server{
+			Addr:    net.JoinHostPort(host, strconv.Itoa(port)),
+			Handler: mux,
+		})
+	}
+	return servers
+}
+
+// startPprofServers runs the pprof servers in the background. A host
+// without IPv6 only fails to serve on ::1.
+func startPprofServers(servers []*http.Server) {
+	for _, srv := range servers {
+		listener, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			slog.Warn("pprof server failed to listen", "addr", srv.Addr, "error", err)
+			continue
+		}
+		slog.Info("pprof server listening", "addr", srv.Addr)
+		go func() {
+			if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+				slog.Error("pprof server failed", "addr", srv.Addr, "error", err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPprofServersBindLoopback(t *testing.T) {
+	servers := newPprofServers(defaultPprofPort)
+	if len(servers) == 0 {
+		t.Fatal("no pprof servers")
+	}
+	for _, srv := range servers {
+		host, _, err := net.SplitHostPort(srv.Addr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			t.Errorf("pprof server address %q is not a loopback address", srv.Addr)
+		}
+	}
+}
+
+func TestHealthServerOmitsPprof(t *testing.T) {
+	setVar(t, &enablePprof, true)
+
+	srv := newHealthServer(defaultHealthPort, 0, "")
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("health server /debug/pprof/ status = %d, want 404", rec.Code)
+	}
+}
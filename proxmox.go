@@ -0,0 +1,810 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errPveshTimeout is returned when pvesh does not finish within pveshTimeout
+var errPveshTimeout = errors.New("pvesh command timed out")
+
+// clusterResourcesPath lists the guests, nodes and storage of the cluster
+const clusterResourcesPath = "/cluster/resources"
+
+var (
+	// proxmoxAPIURL and proxmoxAPIToken select the remote Proxmox API when
+	// both are set
+	proxmoxAPIURL   string
+	proxmoxAPIToken string
+
+	// pveshPath is the pvesh executable, or a wrapper accepting the same
+	// arguments
+	pveshPath = "pvesh"
+
+	// pveshArgs, when set, replaces the arguments used to read the cluster
+	// resources
+	pveshArgs []string
+
+	// humanReadableSizes adds formatted memory and disk sizes to guests
+	humanReadableSizes bool
+
+	// reportTasks includes the running tasks of the cluster in reports
+	reportTasks bool
+
+	// reportStorage includes the storage of every node in reports
+	reportStorage bool
+
+	// detailedCollection fetches the current status of every guest in
+	// addition to the cluster resources
+	detailedCollection bool
+
+	// checkGuestAgent pings the guest agent of running qemu guests
+	checkGuestAgent bool
+
+	// checkOvercommit flags guests whose disks exceed the free space of
+	// their storage. It reads the config of every guest, one request per
+	// guest and collection, and requires reportStorage.
+	checkOvercommit bool
+
+	// collectionConcurrency bounds the per-guest requests in flight during
+	// detailed collection and guest agent checks
+	collectionConcurrency = 8
+
+	// floatPrecision is the number of decimal places reported floats are
+	// rounded to
+	floatPrecision = 2
+
+	// pveshTimeout bounds a single pvesh invocation
+	pveshTimeout = 20 * time.Second
+
+	// pveshRetries is the number of retries after a failed pvesh invocation
+	pveshRetries = 2
+
+	// pveshRetryDelay is the pause between pvesh retries
+	pveshRetryDelay = 2 * time.Second
+)
+
+// clusterResource represents an entry of the Proxmox /cluster/resources list
+type clusterResource struct {
+	Name     string  `json:"name"`
+	Node     string  `json:"node"`
+	Storage  string  `json:"storage"`    // Name of a storage entry
+	Plugin   string  `json:"plugintype"` // Plugin of a storage entry
+	Pool     string  `json:"pool"`
+	Tags     string  `json:"tags"` // Tags separated by ';' or ','
+	Type     string  `json:"type"`
+	Status   string  `json:"status"`
+	CPU      float64 `json:"cpu"`
+	MaxCPU   int     `json:"maxcpu"`
+	Mem      int64   `json:"mem"`     // Mem in bytes
+	MaxMem   int64   `json:"maxmem"`  // MaxMem in bytes
+	Disk     int64   `json:"disk"`    // Disk in bytes
+	MaxDisk  int64   `json:"maxdisk"` // MaxDisk in bytes
+	VMID     int     `json:"vmid"`
+	Template int     `json:"template"`
+
+	Uptime    int64 `json:"uptime"`    // Uptime in seconds
+	NetIn     int64 `json:"netin"`     // NetIn in bytes
+	NetOut    int64 `json:"netout"`    // NetOut in bytes
+	DiskRead  int64 `json:"diskread"`  // DiskRead in bytes
+	DiskWrite int64 `json:"diskwrite"` // DiskWrite in bytes
+}
+
+// GetVMs retrieves VM information from Proxmox VE, using the remote API when
+// PROXMOX_API_URL and PROXMOX_API_TOKEN are set and the local pvesh otherwise
+func (c *Client) GetVMs(ctx context.Context) (*Response, error) {
+	// Convert to the desired structure
+	var vms []VMInfo
+	var nodes []NodeInfo
+	var storage []StorageInfo
+	var free map[string]int64 // Free bytes by node/storage
+	collect := func(res clusterResource) {
+		if reportStorage && res.Type == "storage" {
+			if nodeFilter == "" || res.Node == nodeFilter {
+				res = sanitizeResource(res)
+				storage = append(storage, newStorageInfo(res))
+				free[res.Node+"/"+res.Storage] = res.MaxDisk - res.Disk
+			}
+			return
+		}
+		if res.Type == "node" {
+			if nodeFilter == "" || res.Node == nodeFilter {
+				nodes = append(nodes, newNodeInfo(sanitizeResource(res)))
+			}
+			return
+		}
+
+		res = sanitizeResource(res)
+		vm := VMInfo{
+			UserID:  userForPool(res.Pool, c.UserID()),
+			Name:    res.Name,
+			Node:    res.Node,
+			Pool:    res.Pool,
+			Tags:    splitTags(res.Tags),
+			VMID:    res.VMID,
+			Type:    res.Type,
+			Status:  res.Status,
+			CPU:     res.CPU,
+			MaxCPU:  res.MaxCPU,
+			Mem:     float64(res.Mem) / bytesPerGB,     // Convert from bytes to GB
+			MaxMem:  float64(res.MaxMem) / bytesPerGB,  // Convert from bytes to GB
+			Disk:    float64(res.Disk) / bytesPerTB,    // Convert from bytes to TB
+			MaxDisk: float64(res.MaxDisk) / bytesPerTB, // Convert from bytes to TB
+
+			// Stopped guests report zero for these
+			Uptime:    res.Uptime,
+			NetIn:     res.NetIn,
+			NetOut:    res.NetOut,
+			DiskRead:  res.DiskRead,
+			DiskWrite: res.DiskWrite,
+		}
+
+		// Round to the configured precision
+		vm.CPU = roundFloat(vm.CPU)
+		vm.Mem = roundFloat(vm.Mem)
+		vm.MaxMem = roundFloat(vm.MaxMem)
+		vm.Disk = roundFloat(vm.Disk)
+		vm.MaxDisk = roundFloat(vm.MaxDisk)
+
+		// Derive usage percentages, reporting 0 when the maximum is unknown
+		if res.MaxCPU > 0 {
+			vm.CPUPercent = roundFloat(res.CPU / float64(res.MaxCPU) * 100)
+		}
+		if res.MaxMem > 0 {
+			vm.MemPercent = roundFloat(float64(res.Mem) / float64(res.MaxMem) * 100)
+		}
+
+		if humanReadableSizes {
+			vm.MemHuman = formatBytes(res.Mem)
+			vm.DiskHuman = formatBytes(res.Disk)
+		}
+
+		if includeResource(res) {
+			vms = append(vms, vm)
+		}
+	}
+
+	// Decode the JSON output one resource at a time as it is read
+	err := c.proxmoxRead(ctx, clusterResourcesPath, func(r io.Reader) error {
+		// Start over when a failed pvesh is retried
+		vms, nodes, storage, free = make([]VMInfo, 0), make([]NodeInfo, 0), nil, make(map[string]int64)
+		if err := decodeClusterResources(r, collect); err != nil {
+			return fmt.Errorf("failed to unmarshal JSON: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	vms = sortAndDedupeVMs(vms)
+	if detailedCollection {
+		c.collectDetails(ctx, vms)
+	}
+	if checkGuestAgent {
+		c.checkGuestAgents(ctx, vms)
+	}
+	if reportStorage && checkOvercommit {
+		c.markOvercommitted(ctx, vms, free)
+	}
+
+	response := &Response{
+		UserId:      c.UserID(),
+		Vms:         vms,
+		Nodes:       nodes,
+		CollectedAt: time.Now().UTC().Truncate(time.Second),
+
+		ProxmoxVersion:  c.proxmoxVersion,
+		ClusterDegraded: !c.clusterQuorate(ctx),
+		Storage:         storage,
+	}
+	if reportTasks {
+		response.Tasks = c.runningTasks(ctx)
+	}
+
+	return response, nil
+}
+
+// decodeClusterResources calls fn for every entry of the "data" array of a
+// cluster resources listing as it is read from r, so the listing is never
+// held in memory as a whole and entries that are not reported are dropped
+// as soon as they are decoded
+func decodeClusterResources(r io.Reader, fn func(res clusterResource)) error {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		// Match keys case-insensitively like json.Unmarshal
+		if key, _ := token.(string); !strings.EqualFold(key, "data") {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+			continue
+		}
+
+		token, err = dec.Token()
+		if err != nil {
+			return err
+		}
+		if token == nil {
+			continue
+		}
+		if token != json.Delim('[') {
+			return fmt.Errorf("expected an array of resources, got %v", token)
+		}
+		for dec.More() {
+			var res clusterResource
+			if err := dec.Decode(&res); err != nil {
+				return err
+			}
+			fn(res)
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return err
+		}
+	}
+
+	if err := expectDelim(dec, '}'); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("unexpected data after the resources")
+	}
+	return nil
+}
+
+// expectDelim reads the next token of dec and fails unless it is delim
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("expected %v, got %v", delim, token)
+	}
+	return nil
+}
+
+// clusterQuorate reports whether the cluster has quorum. Standalone nodes,
+// which have no cluster entry, and failures to read the status count as
+// quorate so that only a confirmed loss of quorum flags a report.
+func (c *Client) clusterQuorate(ctx context.Context) bool {
+	output, err := c.proxmoxGet(ctx, "/cluster/status")
+	if err != nil {
+		slog.Warn("Error getting cluster status", "error", err)
+		return true
+	}
+
+	// Accept the result both bare and wrapped in "data"
+	type statusEntry struct {
+		Type    string `json:"type"`
+		Name    string `json:"name"`
+		Quorate int    `json:"quorate"`
+	}
+	var entries []statusEntry
+	var wrapped struct {
+		Data []statusEntry `json:"data"`
+	}
+	if err := json.Unmarshal(output, &wrapped); err == nil {
+		entries = wrapped.Data
+	} else if err := json.Unmarshal(output, &entries); err != nil {
+		slog.Warn("Error parsing cluster status", "error", err)
+		return true
+	}
+
+	for _, entry := range entries {
+		if entry.Type == "cluster" && entry.Quorate == 0 {
+			slog.Warn("Cluster has no quorum, data may be stale or partial", "cluster", entry.Name)
+			return false
+		}
+	}
+	return true
+}
+
+// runningTasks lists the tasks of the cluster that have not finished yet,
+// or none if the tasks cannot be read
+func (c *Client) runningTasks(ctx context.Context) []TaskInfo {
+	output, err := c.proxmoxGet(ctx, "/cluster/tasks")
+	if err != nil {
+		slog.Warn("Error getting cluster tasks", "error", err)
+		return nil
+	}
+
+	// Accept the result both bare and wrapped in "data"
+	type taskEntry struct {
+		Type      string `json:"type"`
+		Status    string `json:"status"`
+		Node      string `json:"node"`
+		ID        string `json:"id"`
+		User      string `json:"user"`
+		StartTime int64  `json:"starttime"`
+		EndTime   int64  `json:"endtime"`
+	}
+	var entries []taskEntry
+	var wrapped struct {
+		Data []taskEntry `json:"data"`
+	}
+	if err := json.Unmarshal(output, &wrapped); err == nil {
+		entries = wrapped.Data
+	} else if err := json.Unmarshal(output, &entries); err != nil {
+		slog.Warn("Error parsing cluster tasks", "error", err)
+		return nil
+	}
+
+	tasks := make([]TaskInfo, 0)
+	for _, entry := range entries {
+		// Finished tasks carry an end time
+		if entry.EndTime != 0 {
+			continue
+		}
+		if nodeFilter != "" && entry.Node != nodeFilter {
+			continue
+		}
+		status := entry.Status
+		if status == "" {
+			status = "running"
+		}
+		tasks = append(tasks, TaskInfo{
+			Type:      entry.Type,
+			Status:    status,
+			Node:      entry.Node,
+			ID:        entry.ID,
+			User:      entry.User,
+			StartTime: time.Unix(entry.StartTime, 0).UTC(),
+		})
+	}
+	return tasks
+}
+
+// guestStatus is the subset of a guest's current status merged into VMInfo
+// by detailed collection
+type guestStatus struct {
+	QMPStatus string `json:"qmpstatus"`
+	Lock      string `json:"lock"`
+	PID       int    `json:"pid"`
+	HA        struct {
+		State string `json:"state"`
+	} `json:"ha"`
+}
+
+// forEachGuest calls fn for every guest with at most collectionConcurrency
+// calls in flight, so that per-guest queries do not spawn hundreds of pvesh
+// processes at once
+func forEachGuest(ctx context.Context, vms []VMInfo, fn func(vm *VMInfo)) {
+	sem := make(chan struct{}, collectionConcurrency)
+	var wg sync.WaitGroup
+
+	for i := range vms {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		}
+
+		wg.Add(1)
+		go func(vm *VMInfo) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(vm)
+		}(&vms[i])
+	}
+
+	wg.Wait()
+}
+
+// collectDetails fetches the current status of every guest and merges it
+// into vms. Guests whose status cannot be read are reported without the
+// details.
+func (c *Client) collectDetails(ctx context.Context, vms []VMInfo) {
+	forEachGuest(ctx, vms, func(vm *VMInfo) {
+		path := fmt.Sprintf("/nodes/%s/%s/%d/status/current", url.PathEscape(vm.Node), vm.Type, vm.VMID)
+		output, err := c.proxmoxGet(ctx, path)
+		if err != nil {
+			slog.Warn("Error fetching guest status", "vmid", vm.VMID, "node", vm.Node, "error", err)
+			return
+		}
+
+		// Accept the result both bare and wrapped in "data"
+		var status struct {
+			guestStatus
+			Data *guestStatus `json:"data"`
+		}
+		if err := json.Unmarshal(output, &status); err != nil {
+			slog.Warn("Error decoding guest status", "vmid", vm.VMID, "node", vm.Node, "error", err)
+			return
+		}
+		current := status.guestStatus
+		if status.Data != nil {
+			current = *status.Data
+		}
+
+		vm.QMPStatus = current.QMPStatus
+		vm.Lock = current.Lock
+		vm.PID = current.PID
+		vm.HAState = current.HA.State
+	})
+}
+
+// checkGuestAgents pings the guest agent of every running qemu guest. The
+// ping is an API action, hence a create rather than a read, and fails when
+// the agent is not installed or the guest OS is unresponsive.
+func (c *Client) checkGuestAgents(ctx context.Context, vms []VMInfo) {
+	forEachGuest(ctx, vms, func(vm *VMInfo) {
+		if vm.Type != "qemu" || vm.Status != "running" {
+			return
+		}
+
+		path := fmt.Sprintf("/nodes/%s/qemu/%d/agent/ping", url.PathEscape(vm.Node), vm.VMID)
+		_, err := c.proxmoxCreate(ctx, path)
+		if err != nil {
+			slog.Debug("Guest agent ping failed", "vmid", vm.VMID, "node", vm.Node, "error", err)
+		}
+		ok := err == nil
+		vm.GuestAgentOK = &ok
+	})
+}
+
+// newNodeInfo converts a node entry of the cluster resources
+func newNodeInfo(res clusterResource) NodeInfo {
+	node := NodeInfo{
+		Node:   res.Node,
+		Status: res.Status,
+		CPU:    res.CPU,
+		MaxCPU: res.MaxCPU,
+		Mem:    float64(res.Mem) / bytesPerGB,    // Convert from bytes to GB
+		MaxMem: float64(res.MaxMem) / bytesPerGB, // Convert from bytes to GB
+		Uptime: res.Uptime,
+	}
+
+	// Round to the configured precision
+	node.CPU = roundFloat(node.CPU)
+	node.Mem = roundFloat(node.Mem)
+	node.MaxMem = roundFloat(node.MaxMem)
+
+	return node
+}
+
+// newStorageInfo converts a storage entry of the cluster resources
+func newStorageInfo(res clusterResource) StorageInfo {
+	return StorageInfo{
+		Storage: res.Storage,
+		Node:    res.Node,
+		Type:    res.Plugin,
+		Used:    roundFloat(float64(res.Disk) / bytesPerGB),    // Convert from bytes to GB
+		Total:   roundFloat(float64(res.MaxDisk) / bytesPerGB), // Convert from bytes to GB
+	}
+}
+
+// sanitizeResource clamps negative counters, which a confused pvesh can
+// report, to zero so the conversions below never produce garbage
+func sanitizeResource(res clusterResource) clusterResource {
+	clamp := func(field string, v *int64) {
+		if *v < 0 {
+			slog.Warn("Clamping negative resource value", "vmid", res.VMID, "node", res.Node, "field", field, "value", *v)
+			*v = 0
+		}
+	}
+	clamp("mem", &res.Mem)
+	clamp("maxmem", &res.MaxMem)
+	clamp("disk", &res.Disk)
+	clamp("maxdisk", &res.MaxDisk)
+
+	if res.CPU < 0 || math.IsNaN(res.CPU) || math.IsInf(res.CPU, 0) {
+		slog.Warn("Clamping invalid resource value", "vmid", res.VMID, "node", res.Node, "field", "cpu", "value", res.CPU)
+		res.CPU = 0
+	}
+	if res.MaxCPU < 0 {
+		slog.Warn("Clamping negative resource value", "vmid", res.VMID, "node", res.Node, "field", "maxcpu", "value", res.MaxCPU)
+		res.MaxCPU = 0
+	}
+	return res
+}
+
+// roundFloat rounds v to floatPrecision decimal places. Values too large
+// to scale are returned unrounded rather than overflowing to infinity.
+func roundFloat(v float64) float64 {
+	scale := math.Pow10(floatPrecision)
+	if math.IsInf(v*scale, 0) {
+		return v
+	}
+	return math.Round(v*scale) / scale
+}
+
+// formatBytes formats a byte count in the largest of MB, GB and TB that
+// keeps the value at least 1, with one decimal place
+func formatBytes(bytes int64) string {
+	switch {
+	case bytes >= bytesPerTB:
+		return fmt.Sprintf("%.1f TB", float64(bytes)/bytesPerTB)
+	case bytes >= bytesPerGB:
+		return fmt.Sprintf("%.1f GB", float64(bytes)/bytesPerGB)
+	default:
+		return fmt.Sprintf("%.1f MB", float64(bytes)/bytesPerMB)
+	}
+}
+
+// splitTags splits a Proxmox tag list on ';' or ',', dropping empty tags
+func splitTags(tags string) []string {
+	fields := strings.FieldsFunc(tags, func(r rune) bool {
+		return r == ';' || r == ','
+	})
+
+	result := make([]string, 0, len(fields))
+	for _, tag := range fields {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+// sortAndDedupeVMs orders guests by VMID and drops repeated VMIDs, which
+// pvesh can report transiently during migrations, keeping the first seen
+func sortAndDedupeVMs(vms []VMInfo) []VMInfo {
+	slices.SortStableFunc(vms, func(a, b VMInfo) int {
+		return cmp.Compare(a.VMID, b.VMID)
+	})
+	return slices.CompactFunc(vms, func(a, b VMInfo) bool {
+		return a.VMID == b.VMID
+	})
+}
+
+// includeResource reports whether a resource passes the configured type,
+// status, template and node filters
+func includeResource(res clusterResource) bool {
+	if !slices.Contains(reportTypes, res.Type) {
+		return false
+	}
+	if reportStatus != "" && res.Status != reportStatus {
+		return false
+	}
+	if excludeTemplates && res.Template == 1 {
+		return false
+	}
+	if nodeFilter != "" && res.Node != nodeFilter {
+		return false
+	}
+	return true
+}
+
+// proxmoxAPIConfig returns the remote Proxmox API settings and whether the
+// remote collection path is active
+func proxmoxAPIConfig() (string, string, bool) {
+	return proxmoxAPIURL, proxmoxAPIToken, proxmoxAPIURL != "" && proxmoxAPIToken != ""
+}
+
+// loadProxmoxAPIConfig reads the remote Proxmox API settings. The token is
+// taken from PROXMOX_API_TOKEN or from the file named by PROXMOX_TOKEN_FILE,
+// which keeps it out of the process environment.
+func loadProxmoxAPIConfig() error {
+	proxmoxAPIURL = os.Getenv("PROXMOX_API_URL")
+	proxmoxAPIToken = os.Getenv("PROXMOX_API_TOKEN")
+
+	tokenFile := os.Getenv("PROXMOX_TOKEN_FILE")
+	if tokenFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return fmt.Errorf("failed to read PROXMOX_TOKEN_FILE: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return fmt.Errorf("PROXMOX_TOKEN_FILE %s is empty", tokenFile)
+	}
+	if proxmoxAPIToken != "" && proxmoxAPIToken != token {
+		return errors.New("PROXMOX_API_TOKEN and PROXMOX_TOKEN_FILE are both set with different values")
+	}
+
+	proxmoxAPIToken = token
+	return nil
+}
+
+// proxmoxGet reads a Proxmox API path, using the remote API when
+// configured and the local pvesh otherwise
+func (c *Client) proxmoxGet(ctx context.Context, path string) ([]byte, error) {
+	var output []byte
+	err := c.proxmoxRead(ctx, path, func(r io.Reader) (err error) {
+		output, err = io.ReadAll(r)
+		return err
+	})
+	return output, err
+}
+
+// proxmoxRead is proxmoxGet passing the response to read as it arrives
+// instead of buffering it, for listings that grow with the cluster
+func (c *Client) proxmoxRead(ctx context.Context, path string, read func(io.Reader) error) error {
+	if apiURL, apiToken, ok := proxmoxAPIConfig(); ok {
+		return c.readAPI(ctx, "GET", apiURL, apiToken, path, read)
+	}
+	return readFromPvesh(ctx, path, read)
+}
+
+// proxmoxCreate invokes a Proxmox API action such as a guest status change.
+// Actions are not idempotent, so unlike reads they are never retried.
+func (c *Client) proxmoxCreate(ctx context.Context, path string) ([]byte, error) {
+	if apiURL, apiToken, ok := proxmoxAPIConfig(); ok {
+		return c.requestAPI(ctx, "POST", apiURL, apiToken, path)
+	}
+	var output []byte
+	var readErr error
+	err := runPveshOnce(ctx, "create", path, func(r io.Reader) {
+		output, readErr = io.ReadAll(r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output, readErr
+}
+
+// LoadProxmoxVersion fetches the Proxmox VE version once so it can be
+// attached to every report. Failures are logged and leave it empty.
+func (c *Client) LoadProxmoxVersion(ctx context.Context) {
+	output, err := c.proxmoxGet(ctx, "/version")
+	if err != nil {
+		slog.Warn("Error getting Proxmox version", "error", err)
+		return
+	}
+
+	// Accept the result both bare and wrapped in "data"
+	var version struct {
+		ProxmoxVersion
+		Data ProxmoxVersion `json:"data"`
+	}
+	if err := json.Unmarshal(output, &version); err != nil {
+		slog.Warn("Error parsing Proxmox version", "error", err)
+		return
+	}
+
+	c.proxmoxVersion = version.ProxmoxVersion
+	if version.Data.Version != "" {
+		c.proxmoxVersion = version.Data
+	}
+	slog.Info("Detected Proxmox version", "version", c.proxmoxVersion.Version, "release", c.proxmoxVersion.Release)
+}
+
+// runPvesh executes pvesh with args, passing its standard output to read
+// while it runs. On failure the error includes what pvesh wrote to
+// standard error. It is a variable so the collection path can be exercised
+// without a Proxmox host.
+var runPvesh = func(ctx context.Context, read func(io.Reader), args ...string) error {
+	cmd := exec.CommandContext(ctx, pveshPath, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// Drain what read left so pvesh does not fail writing to a closed pipe
+	read(stdout)
+	_, _ = io.Copy(io.Discard, stdout)
+
+	if err := cmd.Wait(); err != nil {
+		// pvesh explains permission errors and bad paths on stderr only
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// pveshCommand returns the pvesh arguments running verb on path, honouring
+// the PVESH_ARGS override for the cluster resources read
+func pveshCommand(verb, path string) []string {
+	if verb == "get" && path == clusterResourcesPath && len(pveshArgs) > 0 {
+		return pveshArgs
+	}
+	return []string{verb, path, "--output-format", "json"}
+}
+
+// readFromPvesh reads path from the local pvesh, passing its output to
+// read and retrying transient pvesh failures such as those seen during
+// quorum changes. Errors from read are returned without retrying, as the
+// same output would fail the same way.
+func readFromPvesh(ctx context.Context, path string, read func(io.Reader) error) error {
+	var lastErr error
+	for attempt := 0; attempt <= pveshRetries; attempt++ {
+		if attempt > 0 {
+			slog.Warn("pvesh failed, retrying", "attempt", attempt, "error", lastErr)
+			if err := sleepContext(ctx, pveshRetryDelay); err != nil {
+				return err
+			}
+		}
+
+		var readErr error
+		err := runPveshOnce(ctx, "get", path, func(r io.Reader) {
+			readErr = read(r)
+		})
+		if err == nil {
+			return readErr
+		}
+		lastErr = err
+
+		// A hung pvesh is unlikely to recover within this cycle
+		if errors.Is(err, errPveshTimeout) || ctx.Err() != nil {
+			break
+		}
+	}
+
+	return lastErr
+}
+
+// runPveshOnce executes a pvesh verb on path once, passing its output to
+// read and killing it after pveshTimeout
+func runPveshOnce(ctx context.Context, verb, path string, read func(io.Reader)) error {
+	ctx, cancel := context.WithTimeout(ctx, pveshTimeout)
+	defer cancel()
+
+	err := runPvesh(ctx, read, pveshCommand(verb, path)...)
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%w after %v", errPveshTimeout, pveshTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to execute %s command: %v", pveshPath, err)
+	}
+
+	return nil
+}
+
+// requestAPI calls path on a remote Proxmox API authenticated with an API
+// token of the form USER@REALM!TOKENID=SECRET
+func (c *Client) requestAPI(ctx context.Context, method, apiURL, apiToken, path string) ([]byte, error) {
+	var output []byte
+	err := c.readAPI(ctx, method, apiURL, apiToken, path, func(r io.Reader) (err error) {
+		if output, err = io.ReadAll(r); err != nil {
+			return fmt.Errorf("failed to read proxmox API response: %v", err)
+		}
+		return nil
+	})
+	return output, err
+}
+
+// readAPI is requestAPI passing the response body to read as it arrives
+func (c *Client) readAPI(ctx context.Context, method, apiURL, apiToken, path string, read func(io.Reader) error) error {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(apiURL, "/")+"/api2/json"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "PVEAPIToken="+apiToken)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("proxmox API request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxmox API returned non-OK response: %s", resp.Status)
+	}
+
+	return read(resp.Body)
+}
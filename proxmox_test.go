@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakePvesh replaces pvesh for the test with one printing outputs[path]
+// for "pvesh <verb> <path>" and failing for paths without an output. The
+// cluster status of a standalone node is printed unless outputs has one.
+func fakePvesh(t *testing.T, outputs map[string]string) {
+	t.Helper()
+	setVar(t, &pveshRetries, 0)
+	setVar(t, &runPvesh, func(ctx context.Context, read func(io.Reader), args ...string) error {
+		output, ok := outputs[args[1]]
+		if !ok && args[1] == "/cluster/status" {
+			output, ok = `{"data":[]}`, true
+		}
+		if !ok {
+			return fmt.Errorf("no such path %s", args[1])
+		}
+		read(strings.NewReader(output))
+		return nil
+	})
+}
+
+func TestGetVMsFromPvesh(t *testing.T) {
+	fakePvesh(t, map[string]string{clusterResourcesPath: `{"data":[
+		{"type":"lxc","vmid":200,"name":"dns","node":"pve1","status":"running","pool":"infra","tags":"a;b","cpu":0.5,"maxcpu":2},
+		{"type":"qemu","vmid":100,"name":"web","node":"pve1","status":"running","uptime":60}
+	]}`})
+
+	resp, err := (&Client{}).GetVMs(context.Background())
+	if err != nil {
+		t.Fatalf("GetVMs: %v", err)
+	}
+	if len(resp.Vms) != 2 {
+		t.Fatalf("got %d VMs, want 2: %+v", len(resp.Vms), resp.Vms)
+	}
+
+	web, dns := resp.Vms[0], resp.Vms[1]
+	if web.VMID != 100 || web.Name != "web" || web.Type != "qemu" || web.Node != "pve1" || web.Status != "running" || web.Uptime != 60 {
+		t.Errorf("vms[0] = %+v, want qemu guest 100", web)
+	}
+	if dns.VMID != 200 || dns.Type != "lxc" || dns.Pool != "infra" || !slices.Equal(dns.Tags, []string{"a", "b"}) || dns.CPUPercent != 25 {
+		t.Errorf("vms[1] = %+v, want lxc guest 200", dns)
+	}
+	if resp.ClusterDegraded {
+		t.Error("standalone node reported as degraded")
+	}
+}
+
+func TestGetVMsSkipsNodesAndStorage(t *testing.T) {
+	fakePvesh(t, map[string]string{clusterResourcesPath: `{"data":[
+		{"type":"node","node":"pve1","status":"online","maxcpu":16},
+		{"type":"storage","storage":"local","node":"pve1","plugintype":"dir"},
+		{"type":"sdn","sdn":"localnetwork","node":"pve1"},
+		{"type":"qemu","vmid":100,"name":"web","node":"pve1"}
+	]}`})
+
+	resp, err := (&Client{}).GetVMs(context.Background())
+	if err != nil {
+		t.Fatalf("GetVMs: %v", err)
+	}
+	if len(resp.Vms) != 1 || resp.Vms[0].VMID != 100 {
+		t.Errorf("VMs = %+v, want only guest 100", resp.Vms)
+	}
+	if len(resp.Nodes) != 1 || resp.Nodes[0].Node != "pve1" {
+		t.Errorf("Nodes = %+v, want node pve1", resp.Nodes)
+	}
+	if len(resp.Storage) != 0 {
+		t.Errorf("Storage = %+v, want none without REPORT_STORAGE", resp.Storage)
+	}
+}
+
+func TestGetVMsMalformedJSON(t *testing.T) {
+	for _, output := range []string{``, `not json`, `{"data":[{"type":"qemu","vmid":"x"}]}`, `{"data":[{"type":"qemu"`} {
+		fakePvesh(t, map[string]string{clusterResourcesPath: output})
+		if resp, err := (&Client{}).GetVMs(context.Background()); err == nil {
+			t.Errorf("GetVMs with output %q = %+v, want an error", output, resp)
+		}
+	}
+}
+
+func TestGetVMsPveshFailure(t *testing.T) {
+	fakePvesh(t, nil)
+	if _, err := (&Client{}).GetVMs(context.Background()); err == nil {
+		t.Error("GetVMs succeeded without pvesh output")
+	}
+}
+
+// filterListing holds guests exercising every report filter
+const filterListing = `{"data":[
+	{"type":"qemu","vmid":100,"name":"web","node":"pve1","status":"running"},
+	{"type":"qemu","vmid":101,"name":"db","node":"pve2","status":"stopped"},
+	{"type":"lxc","vmid":200,"name":"dns","node":"pve1","status":"running"},
+	{"type":"qemu","vmid":900,"name":"tmpl","node":"pve1","status":"stopped","template":1}
+]}`
+
+func TestGetVMsFilters(t *testing.T) {
+	tests := []struct {
+		name      string
+		types     []string
+		status    string
+		templates bool
+		node      string
+		want      []int
+	}{
+		{name: "default", types: []string{"qemu", "lxc"}, want: []int{100, 101, 200, 900}},
+		{name: "types", types: []string{"lxc"}, want: []int{200}},
+		{name: "status", types: []string{"qemu", "lxc"}, status: "running", want: []int{100, 200}},
+		{name: "templates", types: []string{"qemu", "lxc"}, templates: true, want: []int{100, 101, 200}},
+		{name: "node", types: []string{"qemu", "lxc"}, node: "pve2", want: []int{101}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakePvesh(t, map[string]string{clusterResourcesPath: filterListing})
+			setVar(t, &reportTypes, tt.types)
+			setVar(t, &reportStatus, tt.status)
+			setVar(t, &excludeTemplates, tt.templates)
+			setVar(t, &nodeFilter, tt.node)
+
+			resp, err := (&Client{}).GetVMs(context.Background())
+			if err != nil {
+				t.Fatalf("GetVMs: %v", err)
+			}
+			var got []int
+			for _, vm := range resp.Vms {
+				got = append(got, vm.VMID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("VMIDs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetVMsUnitConversions(t *testing.T) {
+	setVar(t, &floatPrecision, 2)
+
+	tests := []struct {
+		name     string
+		mem      int64
+		disk     int64
+		wantMem  float64 // GB
+		wantDisk float64 // TB
+	}{
+		{name: "zero", mem: 0, disk: 0, wantMem: 0, wantDisk: 0},
+		{name: "whole", mem: 4 * bytesPerGB, disk: 2 * bytesPerTB, wantMem: 4, wantDisk: 2},
+		{name: "fractional", mem: 1536 * bytesPerMB, disk: bytesPerTB / 4, wantMem: 1.5, wantDisk: 0.25},
+		{name: "rounded", mem: bytesPerGB / 3, disk: bytesPerTB / 3, wantMem: 0.33, wantDisk: 0.33},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakePvesh(t, map[string]string{
+				clusterResourcesPath: fmt.Sprintf(`{"data":[{"type":"qemu","vmid":100,"mem":%d,"maxmem":%d,"disk":%d,"maxdisk":%d}]}`, tt.mem, tt.mem, tt.disk, tt.disk),
+			})
+
+			resp, err := (&Client{}).GetVMs(context.Background())
+			if err != nil {
+				t.Fatalf("GetVMs: %v", err)
+			}
+			vm := resp.Vms[0]
+			if vm.Mem != tt.wantMem || vm.MaxMem != tt.wantMem {
+				t.Errorf("Mem, MaxMem = %v, %v GB, want %v", vm.Mem, vm.MaxMem, tt.wantMem)
+			}
+			if vm.Disk != tt.wantDisk || vm.MaxDisk != tt.wantDisk {
+				t.Errorf("Disk, MaxDisk = %v, %v TB, want %v", vm.Disk, vm.MaxDisk, tt.wantDisk)
+			}
+		})
+	}
+}
+
+func TestSortAndDedupeVMs(t *testing.T) {
+	vms := []VMInfo{
+		{VMID: 300, Name: "c"},
+		{VMID: 100, Name: "a"},
+		{VMID: 200, Name: "b"},
+		{VMID: 100, Name: "a-duplicate"},
+	}
+
+	got := sortAndDedupeVMs(vms)
+	want := []VMInfo{{VMID: 100, Name: "a"}, {VMID: 200, Name: "b"}, {VMID: 300, Name: "c"}}
+	if len(got) != len(want) {
+		t.Fatalf("got %d VMs, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i].VMID != want[i].VMID || got[i].Name != want[i].Name {
+			t.Errorf("vms[%d] = %d %q, want %d %q", i, got[i].VMID, got[i].Name, want[i].VMID, want[i].Name)
+		}
+	}
+}
+
+func TestRoundFloat(t *testing.T) {
+	tests := []struct {
+		precision int
+		v         float64
+		want      float64
+	}{
+		{precision: 0, v: 2.5, want: 3},
+		{precision: 0, v: 0.4999, want: 0},
+		{precision: 2, v: 1.23456, want: 1.23},
+		{precision: 2, v: 0.005, want: 0.01},
+		{precision: 2, v: 3, want: 3},
+		{precision: 4, v: 1.23456, want: 1.2346},
+		{precision: 4, v: 0.00004, want: 0},
+	}
+
+	for _, tt := range tests {
+		setVar(t, &floatPrecision, tt.precision)
+		if got := roundFloat(tt.v); got != tt.want {
+			t.Errorf("roundFloat(%v) at precision %d = %v, want %v", tt.v, tt.precision, got, tt.want)
+		}
+	}
+}
+
+func TestRoundFloatInf(t *testing.T) {
+	setVar(t, &floatPrecision, 2)
+
+	for _, v := range []float64{math.Inf(1), math.Inf(-1), math.MaxFloat64, -math.MaxFloat64} {
+		if got := roundFloat(v); got != v {
+			t.Errorf("roundFloat(%v) = %v, want it unchanged", v, got)
+		}
+	}
+
+	// A huge maximum is reported rather than zeroed
+	fakePvesh(t, map[string]string{
+		clusterResourcesPath: `{"data":[{"type":"qemu","vmid":100,"mem":1073741824,"maxmem":9223372036854775807}]}`,
+	})
+	resp, err := (&Client{}).GetVMs(context.Background())
+	if err != nil {
+		t.Fatalf("GetVMs: %v", err)
+	}
+	vm := resp.Vms[0]
+	if vm.MaxMem < 8e9 {
+		t.Errorf("MaxMem = %v, want about 8.6e9 GB", vm.MaxMem)
+	}
+	if math.IsInf(vm.MemPercent, 0) || math.IsNaN(vm.MemPercent) {
+		t.Errorf("MemPercent = %v, want a finite value", vm.MemPercent)
+	}
+}
+
+// clusterResourcesListing returns a cluster resources listing with n guests
+// and as many storage entries, like pvesh prints on a large cluster
+func clusterResourcesListing(n int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"data":[`)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, `{"id":"qemu/%d","type":"qemu","vmid":%d,"name":"vm-%d","node":"pve%d","status":"running","cpu":0.25,"maxcpu":4,"mem":2147483648,"maxmem":4294967296,"disk":0,"maxdisk":34359738368,"uptime":3600},`, i, i, i, i%8)
+		fmt.Fprintf(&buf, `{"id":"storage/pve%d/local-%d","type":"storage","storage":"local-%d","node":"pve%d","plugintype":"dir","status":"available","disk":1073741824,"maxdisk":107374182400}`, i%8, i, i, i%8)
+	}
+	buf.WriteString(`]}`)
+	return buf.Bytes()
+}
+
+func TestGetVMsOvercommit(t *testing.T) {
+	setVar(t, &reportStorage, true)
+	setVar(t, &floatPrecision, 1)
+
+	// 10741000000 bytes of free space round down to 10.0GB, less than the
+	// disk of guest 100
+	fakePvesh(t, map[string]string{
+		clusterResourcesPath: `{"data":[
+			{"type":"storage","storage":"local-lvm","node":"pve1","disk":0,"maxdisk":10741000000},
+			{"type":"qemu","vmid":100,"node":"pve1","status":"running"},
+			{"type":"qemu","vmid":101,"node":"pve1","status":"running"}
+		]}`,
+		"/nodes/pve1/qemu/100/config": `{"scsi0":"local-lvm:vm-100-disk-0,size=10740000000"}`,
+		"/nodes/pve1/qemu/101/config": `{"scsi0":"local-lvm:vm-101-disk-0,size=10742000000"}`,
+	})
+	var configReads atomic.Int32
+	fake := runPvesh
+	setVar(t, &runPvesh, func(ctx context.Context, read func(io.Reader), args ...string) error {
+		if strings.HasSuffix(args[1], "/config") {
+			configReads.Add(1)
+		}
+		return fake(ctx, read, args...)
+	})
+
+	resp, err := (&Client{}).GetVMs(context.Background())
+	if err != nil {
+		t.Fatalf("GetVMs: %v", err)
+	}
+	if n := configReads.Load(); n != 0 {
+		t.Errorf("read %d guest configs without CHECK_OVERCOMMIT, want 0", n)
+	}
+	for _, vm := range resp.Vms {
+		if vm.Overcommitted {
+			t.Errorf("guest %d overcommitted without CHECK_OVERCOMMIT", vm.VMID)
+		}
+	}
+
+	setVar(t, &checkOvercommit, true)
+	resp, err = (&Client{}).GetVMs(context.Background())
+	if err != nil {
+		t.Fatalf("GetVMs: %v", err)
+	}
+	if resp.Vms[0].Overcommitted {
+		t.Error("guest 100 overcommitted, its disk fits the free space")
+	}
+	if !resp.Vms[1].Overcommitted {
+		t.Error("guest 101 not overcommitted, its disk exceeds the free space")
+	}
+}
+
+// BenchmarkClusterResources compares buffering the whole pvesh output and
+// unmarshalling it, as done before, with decoding it as it is read
+func BenchmarkClusterResources(b *testing.B) {
+	listing := clusterResourcesListing(5000)
+
+	b.Run("buffered", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			output, err := io.ReadAll(bytes.NewReader(listing))
+			if err != nil {
+				b.Fatal(err)
+			}
+			var resources struct {
+				Data []clusterResource `json:"data"`
+			}
+			if err := json.Unmarshal(output, &resources); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("streamed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			err := decodeClusterResources(bytes.NewReader(listing), func(res clusterResource) {})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
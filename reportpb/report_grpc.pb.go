@@ -0,0 +1,152 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             v5.27.2
+// source: report.proto
+
+package reportpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	ReportService_StreamReports_FullMethodName = "/hyperdesk.report.v1.ReportService/StreamReports"
+)
+
+// ReportServiceClient is the client API for ReportService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// ReportService receives the reports of collectors
+type ReportServiceClient interface {
+	// StreamReports sends reports over one long-lived stream, answered with a
+	// summary once the collector closes it
+	StreamReports(ctx context.Context, opts ...grpc.CallOption) (ReportService_StreamReportsClient, error)
+}
+
+type reportServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewReportServiceClient(cc grpc.ClientConnInterface) ReportServiceClient {
+	return &reportServiceClient{cc}
+}
+
+func (c *reportServiceClient) StreamReports(ctx context.Context, opts ...grpc.CallOption) (ReportService_StreamReportsClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ReportService_ServiceDesc.Streams[0], ReportService_StreamReports_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &reportServiceStreamReportsClient{ClientStream: stream}
+	return x, nil
+}
+
+type ReportService_StreamReportsClient interface {
+	Send(*Response) error
+	CloseAndRecv() (*StreamSummary, error)
+	grpc.ClientStream
+}
+
+type reportServiceStreamReportsClient struct {
+	grpc.ClientStream
+}
+
+func (x *reportServiceStreamReportsClient) Send(m *Response) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *reportServiceStreamReportsClient) CloseAndRecv() (*StreamSummary, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(StreamSummary)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReportServiceServer is the server API for ReportService service.
+// All implementations must embed UnimplementedReportServiceServer
+// for forward compatibility
+//
+// ReportService receives the reports of collectors
+type ReportServiceServer interface {
+	// StreamReports sends reports over one long-lived stream, answered with a
+	// summary once the collector closes it
+	StreamReports(ReportService_StreamReportsServer) error
+	mustEmbedUnimplementedReportServiceServer()
+}
+
+// UnimplementedReportServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedReportServiceServer struct {
+}
+
+func (UnimplementedReportServiceServer) StreamReports(ReportService_StreamReportsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamReports not implemented")
+}
+func (UnimplementedReportServiceServer) mustEmbedUnimplementedReportServiceServer() {}
+
+// UnsafeReportServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ReportServiceServer will
+// result in compilation errors.
+type UnsafeReportServiceServer interface {
+	mustEmbedUnimplementedReportServiceServer()
+}
+
+func RegisterReportServiceServer(s grpc.ServiceRegistrar, srv ReportServiceServer) {
+	s.RegisterService(&ReportService_ServiceDesc, srv)
+}
+
+func _ReportService_StreamReports_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ReportServiceServer).StreamReports(&reportServiceStreamReportsServer{ServerStream: stream})
+}
+
+type ReportService_StreamReportsServer interface {
+	SendAndClose(*StreamSummary) error
+	Recv() (*Response, error)
+	grpc.ServerStream
+}
+
+type reportServiceStreamReportsServer struct {
+	grpc.ServerStream
+}
+
+func (x *reportServiceStreamReportsServer) SendAndClose(m *StreamSummary) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *reportServiceStreamReportsServer) Recv() (*Response, error) {
+	m := new(Response)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReportService_ServiceDesc is the grpc.ServiceDesc for ReportService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ReportService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "hyperdesk.report.v1.ReportService",
+	HandlerType: (*ReportServiceServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamReports",
+			Handler:       _ReportService_StreamReports_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "report.proto",
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Supported report schema versions
+const (
+	schemaV1 = "v1"
+	schemaV2 = "v2"
+)
+
+// schemaVersion selects how reports are serialized
+var schemaVersion = schemaV1
+
+// reportFields lists the VMInfo JSON fields included in reports, or every
+// field when empty
+var reportFields []string
+
+// requiredFields are always reported so guests remain attributable
+var requiredFields = []string{"vmid", "userId"}
+
+// reportEnvelope is the v2 report schema wrapping the v1 payload
+type reportEnvelope struct {
+	SchemaVersion string          `json:"schemaVersion"`
+	Collector     collectorInfo   `json:"collector"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// collectorInfo identifies the collector in a v2 envelope
+type collectorInfo struct {
+	ID      string `json:"id"`
+	Version string `json:"version"`
+}
+
+// marshalReport serializes a report using the given schema version: v1 is
+// the flat Response, v2 wraps it in a reportEnvelope
+func marshalReport(vmList Response, schema string) ([]byte, error) {
+	if schema != schemaV1 && schema != schemaV2 {
+		return nil, fmt.Errorf("unsupported schema version %q", schema)
+	}
+
+	data, err := json.Marshal(vmList)
+	if err != nil {
+		return nil, err
+	}
+	if len(reportFields) > 0 {
+		if data, err = filterVMFields(data, reportFields); err != nil {
+			return nil, err
+		}
+	}
+
+	return wrapSchema(data, vmList.CollectorID, schema)
+}
+
+// marshalHeartbeat serializes a heartbeat using the given schema version,
+// wrapped in a reportEnvelope for v2 like a report
+func marshalHeartbeat(heartbeat Heartbeat, schema string) ([]byte, error) {
+	if schema != schemaV1 && schema != schemaV2 {
+		return nil, fmt.Errorf("unsupported schema version %q", schema)
+	}
+
+	data, err := json.Marshal(heartbeat)
+	if err != nil {
+		return nil, err
+	}
+	return wrapSchema(data, heartbeat.CollectorID, schema)
+}
+
+// wrapSchema returns a serialized v1 payload as sent with the given schema
+// version: unchanged for v1 and wrapped in a reportEnvelope for v2
+func wrapSchema(data []byte, collectorID, schema string) ([]byte, error) {
+	if schema == schemaV1 {
+		return data, nil
+	}
+	return json.Marshal(reportEnvelope{
+		SchemaVersion: schemaV2,
+		Collector: collectorInfo{
+			ID:      collectorID,
+			Version: version,
+		},
+		Data: data,
+	})
+}
+
+// filterVMFields drops every field of the guests in a serialized Response
+// that is neither in fields nor required
+func filterVMFields(data []byte, fields []string) ([]byte, error) {
+	var report map[string]json.RawMessage
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, err
+	}
+	var vms []map[string]json.RawMessage
+	if err := json.Unmarshal(report["vms"], &vms); err != nil {
+		return nil, err
+	}
+
+	for _, vm := range vms {
+		for name := range vm {
+			if !slices.Contains(fields, name) && !slices.Contains(requiredFields, name) {
+				delete(vm, name)
+			}
+		}
+	}
+
+	filtered, err := json.Marshal(vms)
+	if err != nil {
+		return nil, err
+	}
+	report["vms"] = filtered
+	return json.Marshal(report)
+}
+
+// vmFieldNames returns the JSON names of the VMInfo fields
+func vmFieldNames() []string {
+	t := reflect.TypeOf(VMInfo{})
+	names := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		names = append(names, name)
+	}
+	return names
+}
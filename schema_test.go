@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+// testReport is a minimal report with a single guest
+var testReport = Response{
+	UserId:      "user",
+	CollectorID: "collector",
+	Vms:         []VMInfo{{UserID: "user", VMID: 100, Name: "web", Mem: 2}},
+}
+
+func TestMarshalReportV1(t *testing.T) {
+	data, err := marshalReport(testReport, schemaV1)
+	if err != nil {
+		t.Fatalf("marshalReport: %v", err)
+	}
+
+	var got Response
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("v1 report is not a Response: %v", err)
+	}
+	if got.UserId != "user" || len(got.Vms) != 1 || got.Vms[0].VMID != 100 {
+		t.Errorf("v1 report = %+v, want the flat report", got)
+	}
+}
+
+func TestMarshalReportV2(t *testing.T) {
+	data, err := marshalReport(testReport, schemaV2)
+	if err != nil {
+		t.Fatalf("marshalReport: %v", err)
+	}
+
+	var envelope reportEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		t.Fatalf("v2 report is not an envelope: %v", err)
+	}
+	if envelope.SchemaVersion != schemaV2 {
+		t.Errorf("schemaVersion = %q, want %q", envelope.SchemaVersion, schemaV2)
+	}
+	if envelope.Collector.ID != "collector" || envelope.Collector.Version != version {
+		t.Errorf("collector = %+v, want id collector and version %s", envelope.Collector, version)
+	}
+
+	var got Response
+	if err := json.Unmarshal(envelope.Data, &got); err != nil {
+		t.Fatalf("v2 data is not a Response: %v", err)
+	}
+	if got.UserId != "user" || len(got.Vms) != 1 || got.Vms[0].VMID != 100 {
+		t.Errorf("v2 data = %+v, want the flat report", got)
+	}
+}
+
+func TestMarshalReportUnsupportedVersion(t *testing.T) {
+	if _, err := marshalReport(testReport, "v3"); err == nil {
+		t.Error("marshalReport accepted schema v3")
+	}
+}
+
+func TestMarshalReportFieldAllowlist(t *testing.T) {
+	setVar(t, &reportFields, []string{"name", "mem"})
+
+	data, err := marshalReport(testReport, schemaV1)
+	if err != nil {
+		t.Fatalf("marshalReport: %v", err)
+	}
+
+	var report struct {
+		UserID string                       `json:"userId"`
+		Vms    []map[string]json.RawMessage `json:"vms"`
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("filtered report is not JSON: %v", err)
+	}
+	if report.UserID != "user" {
+		t.Errorf("userId = %q, want the report fields kept", report.UserID)
+	}
+	if len(report.Vms) != 1 {
+		t.Fatalf("got %d VMs, want 1", len(report.Vms))
+	}
+
+	var got []string
+	for name := range report.Vms[0] {
+		got = append(got, name)
+	}
+	slices.Sort(got)
+	want := []string{"mem", "name", "userId", "vmid"}
+	if !slices.Equal(got, want) {
+		t.Errorf("VM fields = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// spoolDir holds reports that could not be delivered to the server
+	spoolDir = "spool"
+
+	// maxSpoolFiles caps the number of spooled reports kept on disk
+	maxSpoolFiles = 100
+)
+
+// spoolReport writes an undelivered report to a timestamped file in the
+// spool directory, discarding the oldest files beyond maxSpoolFiles
+func spoolReport(response Response) error {
+	if err := os.MkdirAll(spoolDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create spool directory: %v", err)
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	// Timestamped names sort lexically in collection order
+	name := time.Now().UTC().Format("20060102T150405.000000000") + ".json"
+	if err := os.WriteFile(filepath.Join(spoolDir, name), data, 0o600); err != nil {
+		return fmt.Errorf("failed to write spool file: %v", err)
+	}
+
+	files, err := spooledFiles()
+	if err != nil {
+		return err
+	}
+	for len(files) > maxSpoolFiles {
+		slog.Warn("Spool full, discarding oldest report", "file", files[0])
+		if err := os.Remove(files[0]); err != nil {
+			return fmt.Errorf("failed to remove spool file: %v", err)
+		}
+		files = files[1:]
+	}
+
+	return nil
+}
+
+// drainSpool sends spooled reports oldest first, removing each once it has
+// been delivered. It stops at the first failure so ordering is preserved.
+func drainSpool(send func(Response) error) error {
+	files, err := spooledFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read spool file: %v", err)
+		}
+
+		var response Response
+		if err := json.Unmarshal(data, &response); err != nil {
+			// A corrupt file would block the spool forever, so drop it
+			slog.Warn("Discarding unreadable spool file", "file", file, "error", err)
+			os.Remove(file)
+			continue
+		}
+
+		if err := send(response); errors.Is(err, errPayloadTooLarge) {
+			// An oversized report would never be accepted either
+			slog.Warn("Discarding oversized spool file", "file", file, "error", err)
+			os.Remove(file)
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := os.Remove(file); err != nil {
+			return fmt.Errorf("failed to remove spool file: %v", err)
+		}
+		slog.Info("Delivered spooled report", "file", file)
+	}
+
+	return nil
+}
+
+// spooledFiles lists the spool files in oldest-first order
+func spooledFiles() ([]string, error) {
+	entries, err := os.ReadDir(spoolDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory: %v", err)
+	}
+
+	// ReadDir returns entries sorted by filename
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			files = append(files, filepath.Join(spoolDir, entry.Name()))
+		}
+	}
+
+	return files, nil
+}
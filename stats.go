@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// processStart is when the collector process started
+var processStart = time.Now()
+
+// reportSelfStats attaches the collector's own process statistics to reports
+var reportSelfStats bool
+
+// CollectorStats describes the resource usage of the collector process
+type CollectorStats struct {
+	CPUSeconds float64 `json:"cpuSeconds"` // CPU time used by the process
+	RSSBytes   uint64  `json:"rssBytes"`   // Resident set size in bytes
+	Goroutines int     `json:"goroutines"`
+	Uptime     int64   `json:"uptime"` // Uptime in seconds
+}
+
+// collectorStats samples the collector's own process statistics
+func collectorStats() *CollectorStats {
+	samples := []metrics.Sample{
+		{Name: "/cpu/classes/total:cpu-seconds"},
+		{Name: "/cpu/classes/idle:cpu-seconds"},
+		{Name: "/memory/classes/total:bytes"},
+	}
+	metrics.Read(samples)
+
+	stats := &CollectorStats{
+		Goroutines: runtime.NumGoroutine(),
+		Uptime:     int64(time.Since(processStart).Seconds()),
+	}
+
+	// The runtime's CPU classes count the time available to all Ps and are
+	// only updated at GC, so they are merely a fallback for getrusage
+	if cpu, ok := processCPUSeconds(); ok {
+		stats.CPUSeconds = roundFloat(cpu)
+	} else if samples[0].Value.Kind() == metrics.KindFloat64 && samples[1].Value.Kind() == metrics.KindFloat64 {
+		stats.CPUSeconds = roundFloat(samples[0].Value.Float64() - samples[1].Value.Float64())
+	}
+
+	// Prefer the kernel's view of the resident set, falling back to the
+	// memory mapped by the Go runtime off Linux
+	if rss, ok := residentBytes(); ok {
+		stats.RSSBytes = rss
+	} else if samples[2].Value.Kind() == metrics.KindUint64 {
+		stats.RSSBytes = samples[2].Value.Uint64()
+	}
+	return stats
+}
+
+// residentBytes reads the resident set size from /proc/self/statm
+func residentBytes() (uint64, bool) {
+	data, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0, false
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return pages * uint64(os.Getpagesize()), true
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// processCPUSeconds is unavailable off Unix, where collectorStats falls back
+// to the Go runtime's estimate
+func processCPUSeconds() (float64, bool) {
+	return 0, false
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// poolUserMap attributes the guests of a Proxmox pool to a user other than
+// the logged-in one, letting one collector report for several tenants
+var poolUserMap map[string]string
+
+// parsePoolUserMap parses pool:user pairs
+func parsePoolUserMap(pairs []string) (map[string]string, error) {
+	mapping := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		pool, user, ok := strings.Cut(pair, ":")
+		pool, user = strings.TrimSpace(pool), strings.TrimSpace(user)
+		if !ok || pool == "" || user == "" {
+			return nil, fmt.Errorf("invalid entry %q, expected pool:user", pair)
+		}
+		mapping[pool] = user
+	}
+	return mapping, nil
+}
+
+// userForPool returns the user owning the guests of pool, or defaultUser
+// for unmapped pools
+func userForPool(pool, defaultUser string) string {
+	if user, ok := poolUserMap[pool]; ok {
+		return user
+	}
+	return defaultUser
+}
+
+// splitByUser splits a report into one report per user owning guests. The
+// report of the logged-in user is always first and always present, even
+// when all guests belong to other users. Other users only receive their
+// guests and the tasks acting on them: nodes, storage, collector stats and
+// tasks acting on no reported guest describe the shared cluster and go to
+// the logged-in user alone.
+func splitByUser(response Response) []Response {
+	if len(poolUserMap) == 0 {
+		return []Response{response}
+	}
+
+	reports := []Response{response}
+	reports[0].Vms = make([]VMInfo, 0)
+	reports[0].Tasks = nil
+	index := map[string]int{response.UserId: 0}
+	owner := make(map[string]int, len(response.Vms)) // VMID to report index
+	for _, vm := range response.Vms {
+		i, ok := index[vm.UserID]
+		if !ok {
+			i = len(reports)
+			index[vm.UserID] = i
+			report := response
+			report.UserId = vm.UserID
+			report.Vms = make([]VMInfo, 0)
+			report.Nodes = make([]NodeInfo, 0)
+			report.Storage = nil
+			report.Tasks = nil
+			report.CollectorStats = nil
+			reports = append(reports, report)
+		}
+		reports[i].Vms = append(reports[i].Vms, vm)
+		owner[strconv.Itoa(vm.VMID)] = i
+	}
+
+	for _, task := range response.Tasks {
+		i := owner[task.ID]
+		reports[i].Tasks = append(reports[i].Tasks, task)
+	}
+	return reports
+}
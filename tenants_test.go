@@ -0,0 +1,69 @@
+package main
+
+import "testing"
+
+func TestSplitByUserFiltersTasks(t *testing.T) {
+	setVar(t, &poolUserMap, map[string]string{"a": "tenant-a", "b": "tenant-b"})
+
+	response := Response{
+		UserId: "operator",
+		Vms: []VMInfo{
+			{UserID: "operator", VMID: 100},
+			{UserID: "tenant-a", VMID: 200, Pool: "a"},
+			{UserID: "tenant-b", VMID: 300, Pool: "b"},
+		},
+		Nodes:   []NodeInfo{{Node: "pve1"}},
+		Storage: []StorageInfo{{Storage: "local"}},
+		Tasks: []TaskInfo{
+			{Type: "qmstart", ID: "100", User: "root@pam"},
+			{Type: "vzdump", ID: "200", User: "alice@pve"},
+			{Type: "qmigrate", ID: "300", User: "bob@pve"},
+			{Type: "aptupdate", ID: "", User: "root@pam"},
+		},
+	}
+
+	reports := splitByUser(response)
+	if len(reports) != 3 {
+		t.Fatalf("got %d reports, want 3", len(reports))
+	}
+	byUser := make(map[string]Response)
+	for _, report := range reports {
+		byUser[report.UserId] = report
+	}
+
+	wantTasks := map[string][]string{
+		"operator": {"100", ""},
+		"tenant-a": {"200"},
+		"tenant-b": {"300"},
+	}
+	for user, want := range wantTasks {
+		var got []string
+		for _, task := range byUser[user].Tasks {
+			got = append(got, task.ID)
+		}
+		if len(got) != len(want) {
+			t.Errorf("%s tasks = %q, want %q", user, got, want)
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s tasks = %q, want %q", user, got, want)
+				break
+			}
+		}
+	}
+
+	for _, task := range byUser["tenant-b"].Tasks {
+		if task.ID == "200" {
+			t.Error("tenant-b received a task for tenant-a's guest 200")
+		}
+	}
+	for _, user := range []string{"tenant-a", "tenant-b"} {
+		if r := byUser[user]; len(r.Nodes) != 0 || len(r.Storage) != 0 {
+			t.Errorf("%s received nodes %v and storage %v, want the logged-in user only", user, r.Nodes, r.Storage)
+		}
+	}
+	if r := byUser["operator"]; len(r.Nodes) != 1 || len(r.Storage) != 1 {
+		t.Errorf("operator nodes %v and storage %v, want the cluster's", r.Nodes, r.Storage)
+	}
+}
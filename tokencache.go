@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// saveTokenCache writes the client's identity and tokens to path with mode
+// 0600. The file is replaced atomically so a crash never leaves it corrupt.
+func saveTokenCache(path string, tokens LoginResponse) error {
+	data, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".token-cache-*")
+	if err != nil {
+		return fmt.Errorf("failed to create token cache: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set token cache permissions: %v", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write token cache: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write token cache: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write token cache: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace token cache: %v", err)
+	}
+	return nil
+}
+
+// loadTokenCache reads tokens previously written by saveTokenCache
+func loadTokenCache(path string) (*LoginResponse, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens LoginResponse
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("failed to parse token cache: %v", err)
+	}
+	return &tokens, nil
+}
+
+// RestoreSession resumes the session saved in the token cache by refreshing
+// its tokens. It reports false when there is no usable cached session and a
+// full login is required.
+func (c *Client) RestoreSession(ctx context.Context) bool {
+	if c.TokenCacheFile == "" {
+		return false
+	}
+
+	tokens, err := loadTokenCache(c.TokenCacheFile)
+	if os.IsNotExist(err) {
+		return false
+	}
+	if err != nil {
+		slog.Warn("Ignoring unreadable token cache", "file", c.TokenCacheFile, "error", err)
+		return false
+	}
+	if tokens.RefreshToken == "" || tokens.UserID == "" {
+		return false
+	}
+
+	c.auth.set(LoginResponse{UserID: tokens.UserID, RefreshToken: tokens.RefreshToken})
+	if _, err := c.RefreshAccessToken(ctx); err != nil {
+		slog.Warn("Cached session could not be refreshed, logging in again", "error", err)
+		c.auth.set(LoginResponse{})
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// defaultWatchdogGraceSeconds is how far past the second scheduled run
+// after the last completed report the watchdog waits before giving up when
+// WATCHDOG_GRACE_SECONDS is unset
+const defaultWatchdogGraceSeconds = 120
+
+// watchdog exits the process when reports stop completing, e.g. because the
+// scheduler died or a report deadlocked, so a supervisor can restart it
+// instead of the client silently going quiet
+type watchdog struct {
+	last atomic.Int64 // UnixNano of the last completed report
+}
+
+// newWatchdog creates a watchdog counting from now
+func newWatchdog() *watchdog {
+	w := &watchdog{}
+	w.touch()
+	return w
+}
+
+// touch records a completed report
+func (w *watchdog) touch() {
+	w.last.Store(time.Now().UnixNano())
+}
+
+// deadline returns when the watchdog gives up if no further report
+// completes: slack past the second scheduled run after last, leaving the
+// next run a full schedule gap to finish. Deriving it from the schedule
+// keeps irregular cron specs such as weekdays only from tripping it.
+func deadline(last time.Time, next func(time.Time) time.Time, slack time.Duration) time.Time {
+	return next(next(last)).Add(slack)
+}
+
+// scheduleGapSamples is the number of upcoming runs shortestGap inspects
+const scheduleGapSamples = 100
+
+// shortestGap returns the shortest time between consecutive scheduled runs
+// among the next scheduleGapSamples after from
+func shortestGap(next func(time.Time) time.Time, from time.Time) time.Duration {
+	prev := next(from)
+	gap := time.Duration(math.MaxInt64)
+	for i := 0; i < scheduleGapSamples; i++ {
+		run := next(prev)
+		gap = min(gap, run.Sub(prev))
+		prev = run
+	}
+	return gap
+}
+
+// capRetryAfter returns the Retry-After cap letting retries waits fit in
+// budget. It never exceeds configured nor goes below floor, unless
+// configured itself is lower.
+func capRetryAfter(configured, floor, budget time.Duration, retries int) time.Duration {
+	return min(configured, max(budget/time.Duration(retries), min(configured, floor)))
+}
+
+// run periodically checks whether a report completed before its deadline,
+// exiting with a non-zero status when none did. next returns the first
+// scheduled run after a given time. It returns when ctx is cancelled.
+func (w *watchdog) run(ctx context.Context, next func(time.Time) time.Time, slack time.Duration) {
+	ticker := time.NewTicker(min(max(slack/4, time.Second), time.Minute))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			last := time.Unix(0, w.last.Load())
+			if due := deadline(last, next, slack); now.After(due) {
+				fatal("Watchdog: no report completed in time, exiting so the supervisor restarts the client", "lastCompleted", last.UTC(), "deadline", due.UTC())
+			}
+		}
+	}
+}
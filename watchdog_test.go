@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+func TestShortestGap(t *testing.T) {
+	from := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC) // A Friday
+
+	every := func(d time.Duration) func(time.Time) time.Time {
+		return func(t time.Time) time.Time { return t.Add(d) }
+	}
+	if got := shortestGap(every(30*time.Second), from); got != 30*time.Second {
+		t.Errorf("interval gap = %v, want 30s", got)
+	}
+
+	weekdays, err := cron.ParseStandard("0 9 * * 1-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := shortestGap(weekdays.Next, from); got != 24*time.Hour {
+		t.Errorf("weekday gap = %v, want 24h", got)
+	}
+}
+
+func TestDeadlineSpansWeekend(t *testing.T) {
+	weekdays, err := cron.ParseStandard("0 9 * * 1-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	friday := time.Date(2026, 10, 16, 9, 1, 0, 0, time.Local)
+	due := deadline(friday, weekdays.Next, 2*time.Minute)
+	if want := time.Date(2026, 10, 20, 9, 2, 0, 0, time.Local); !due.Equal(want) {
+		t.Errorf("deadline after Friday's report = %v, want Tuesday %v", due, want)
+	}
+}
+
+func TestCapRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured time.Duration
+		floor      time.Duration
+		budget     time.Duration
+		want       time.Duration
+	}{
+		{name: "fits", configured: 5 * time.Minute, floor: 30 * time.Second, budget: 24 * time.Hour, want: 5 * time.Minute},
+		{name: "short interval", configured: 5 * time.Minute, floor: 30 * time.Second, budget: 150 * time.Second, want: 50 * time.Second},
+		{name: "no grace", configured: 5 * time.Minute, floor: 30 * time.Second, budget: 5 * time.Minute, want: 100 * time.Second},
+		{name: "floor", configured: 5 * time.Minute, floor: 30 * time.Second, budget: 10 * time.Second, want: 30 * time.Second},
+		{name: "configured below floor", configured: 10 * time.Second, floor: 30 * time.Second, budget: 3 * time.Second, want: 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := capRetryAfter(tt.configured, tt.floor, tt.budget, 3); got != tt.want {
+			t.Errorf("%s: capRetryAfter = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
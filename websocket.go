@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Report transports selected by TRANSPORT
+const (
+	transportHTTP      = "http"
+	transportWebSocket = "websocket"
+)
+
+// streamEndpoint returns the WebSocket report stream of the backend at
+// serverURL
+func streamEndpoint(serverURL string) string {
+	if rest, ok := strings.CutPrefix(serverURL, "https://"); ok {
+		return "wss://" + rest + apiBasePath + "/vm/stream"
+	}
+	return "ws://" + strings.TrimPrefix(serverURL, "http://") + apiBasePath + "/vm/stream"
+}
+
+// wsTransport pushes reports over a persistent WebSocket connection per
+// backend, reconnecting when a connection drops. Messages carry the same
+// payload as the HTTP transport's POST bodies.
+type wsTransport struct {
+	client *Client
+	dialer *websocket.Dialer
+
+	mu    sync.Mutex
+	conns map[string]*websocket.Conn
+}
+
+// newWSTransport creates a WebSocket transport sharing the proxy, dialer and
+// TLS settings of the client's HTTP transport
+func newWSTransport(client *Client) *wsTransport {
+	dialer := &websocket.Dialer{
+		Proxy:             proxyFunc,
+		HandshakeTimeout:  client.httpClient.Timeout,
+		EnableCompression: compressReports,
+		TLSClientConfig:   &tls.Config{},
+	}
+	if transport, ok := client.httpClient.Transport.(*http.Transport); ok {
+		dialer.NetDialContext = transport.DialContext
+		if transport.TLSClientConfig != nil {
+			dialer.TLSClientConfig = transport.TLSClientConfig.Clone()
+		}
+	}
+	// The upgrade handshake requires HTTP/1.1
+	dialer.TLSClientConfig.NextProtos = nil
+
+	return &wsTransport{
+		client: client,
+		dialer: dialer,
+		conns:  make(map[string]*websocket.Conn),
+	}
+}
+
+// SendToURL writes the report to the stream of the backend at serverURL.
+// A failed write drops the connection and is retried on a new one with
+// exponential backoff up to maxRetries attempts.
+func (t *wsTransport) SendToURL(ctx context.Context, serverURL string, vmList Response) error {
+	if t.client.AccessToken() == "" {
+		return errors.New("no access token available, refusing to send unauthenticated request")
+	}
+
+	data, err := marshalReport(vmList, schemaVersion)
+	if err != nil {
+		return err
+	}
+	if err := checkPayloadSize(data, len(vmList.Vms)); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	var lastErr error
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		if attempt > 1 {
+			delay := retryBaseDelay * time.Duration(1<<(attempt-2))
+			slog.Warn("Stream write failed, reconnecting", "attempt", attempt-1, "maxRetries", maxRetries, "error", lastErr, "delay", delay.String())
+			if err := sleepContext(ctx, delay); err != nil {
+				return err
+			}
+		}
+
+		err := t.write(ctx, serverURL, data)
+		if err == nil {
+			slog.Info("Report streamed", "url", serverURL, "vms", len(vmList.Vms), "bytes", len(data), "duration", time.Since(start).String())
+			return nil
+		}
+		lastErr = err
+
+		// A rejected handshake will not succeed on retry
+		if statusCode(err) != 0 && statusCode(err) < 500 {
+			break
+		}
+	}
+
+	return lastErr
+}
+
+// write sends one message, dialing the backend first if needed
+func (t *wsTransport) write(ctx context.Context, serverURL string, data []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	conn := t.conns[serverURL]
+	if conn == nil {
+		var err error
+		conn, err = t.dial(ctx, serverURL)
+		if err != nil {
+			return err
+		}
+		t.conns[serverURL] = conn
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(t.client.httpClient.Timeout))
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		conn.Close()
+		delete(t.conns, serverURL)
+		return fmt.Errorf("stream write failed: %w", err)
+	}
+	return nil
+}
+
+// dial opens an authenticated stream to serverURL. The caller holds t.mu.
+func (t *wsTransport) dial(ctx context.Context, serverURL string) (*websocket.Conn, error) {
+	// Reuse the HTTP transport's headers and authentication
+	req, err := t.client.newRequest(ctx, "GET", streamEndpoint(serverURL), nil)
+	if err != nil {
+		return nil, err
+	}
+	t.client.setBearer(req)
+	header := req.Header.Clone()
+	header.Del("Content-Type")
+
+	conn, resp, err := t.dialer.DialContext(ctx, streamEndpoint(serverURL), header)
+	if err != nil {
+		if resp != nil {
+			resp.Body.Close()
+			return nil, &statusError{StatusCode: resp.StatusCode, Status: resp.Status}
+		}
+		return nil, fmt.Errorf("stream connection failed: %w", err)
+	}
+	slog.Info("Connected report stream", "url", serverURL)
+
+	// Drain incoming frames so pings and close frames are handled, and
+	// forget the connection once the backend drops it
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				t.mu.Lock()
+				if t.conns[serverURL] == conn {
+					delete(t.conns, serverURL)
+				}
+				t.mu.Unlock()
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	return conn, nil
+}
+
+// Close closes every open stream
+func (t *wsTransport) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for serverURL, conn := range t.conns {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		conn.Close()
+		delete(t.conns, serverURL)
+	}
+}